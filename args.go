@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"math"
+)
+
+// Args are key-value pairs of query string or urlencoded form, decoded in place.
+// Keys and values point into parsed buffer, so they are valid only while it is.
+type Args struct {
+	kvs []argKV
+}
+
+type argKV struct {
+	key   []byte
+	value []byte
+}
+
+// Args returns query string arguments, parsed on the first call. Decoding is in place,
+// so QueryString must not be used after that, proxies must forward it before.
+func (r *Request) Args() *Args {
+	if !r.argsParsed {
+		r.args.Parse(r.QueryString)
+		r.argsParsed = true
+	}
+	return &r.args
+}
+
+// Parse splits b by '&' and '=', decoding '+' and percent-escapes of keys and values in place.
+// Empty pairs are skipped, key without '=' has empty value. Invalid escapes are kept as is.
+func (a *Args) Parse(b []byte) {
+	a.kvs = a.kvs[:0]
+	for len(b) != 0 {
+		var pair []byte
+		if amp := bytes.IndexByte(b, '&'); amp >= 0 {
+			pair, b = b[:amp], b[amp+1:]
+		} else {
+			pair, b = b, nil
+		}
+		if len(pair) == 0 {
+			continue
+		}
+		key, value := pair, pair[len(pair):]
+		if eq := bytes.IndexByte(pair, '='); eq >= 0 {
+			key, value = pair[:eq], pair[eq+1:]
+		}
+		a.kvs = append(a.kvs, argKV{key: decodeArg(key), value: decodeArg(value)})
+	}
+}
+
+// decodeArg decodes b in place and returns decoded part, which is never longer
+func decodeArg(b []byte) []byte {
+	w := 0
+	for i := 0; i < len(b); i++ {
+		input := b[i]
+		switch {
+		case input == '+':
+			input = ' '
+		case input == '%' && i+2 < len(b) && fromHexDigit(b[i+1]) >= 0 && fromHexDigit(b[i+2]) >= 0:
+			input = byte(fromHexDigit(b[i+1])*16 + fromHexDigit(b[i+2]))
+			i += 2
+		}
+		b[w] = input
+		w++
+	}
+	return b[:w]
+}
+
+func (a *Args) Len() int { return len(a.kvs) }
+
+// Peek returns the first value of key, nil if not found
+func (a *Args) Peek(key string) []byte {
+	for i := range a.kvs {
+		if string(a.kvs[i].key) == key {
+			return a.kvs[i].value
+		}
+	}
+	return nil
+}
+
+// PeekMulti appends all values of key to dst, pass scratch array to avoid allocation
+func (a *Args) PeekMulti(dst [][]byte, key string) [][]byte {
+	for i := range a.kvs {
+		if string(a.kvs[i].key) == key {
+			dst = append(dst, a.kvs[i].value)
+		}
+	}
+	return dst
+}
+
+func (a *Args) Has(key string) bool {
+	for i := range a.kvs {
+		if string(a.kvs[i].key) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Int returns the first value of key as decimal integer, false if not found, invalid or out of range
+func (a *Args) Int(key string) (int, bool) {
+	value := a.Peek(key)
+	if len(value) == 0 {
+		return 0, false
+	}
+	negative := value[0] == '-'
+	if negative || value[0] == '+' {
+		value = value[1:]
+	}
+	if len(value) == 0 || len(value) > 19 { // So uint64 cannot overflow
+		return 0, false
+	}
+	var n uint64
+	for _, c := range value {
+		if !isDigit(c) {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	if n > math.MaxInt {
+		return 0, false
+	}
+	if negative {
+		return -int(n), true
+	}
+	return int(n), true
+}
+
+// VisitAll calls f for every pair in order, including repeated keys
+func (a *Args) VisitAll(f func(key []byte, value []byte)) {
+	for i := range a.kvs {
+		f(a.kvs[i].key, a.kvs[i].value)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestArgsParse(t *testing.T) {
+	var a Args
+	a.Parse([]byte("a=1&b=x+y%20z&&c&a=2&bad=%zz%4&e=&n=-42&big=99999999999999999999&k%3D=v%26"))
+	for _, tc := range []struct {
+		key  string
+		want string
+	}{
+		{"a", "1"},
+		{"b", "x y z"},
+		{"bad", "%zz%4"}, // Invalid escapes are kept
+		{"k=", "v&"},
+		{"e", ""},
+		{"c", ""},
+	} {
+		if got := a.Peek(tc.key); got == nil || string(got) != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.key, got, tc.want)
+		}
+	}
+	if a.Peek("zz") != nil || a.Has("zz") || !a.Has("c") {
+		t.Fatal(a.kvs)
+	}
+	if got := fmt.Sprintf("%s", a.PeekMulti(nil, "a")); got != "[1 2]" {
+		t.Fatal(got)
+	}
+	count := 0
+	a.VisitAll(func(key []byte, value []byte) { count++ })
+	if count != a.Len() || count != 9 {
+		t.Fatal(count, a.Len())
+	}
+}
+
+func TestArgsInt(t *testing.T) {
+	var a Args
+	a.Parse([]byte("n=-42&big=99999999999999999999&b=x&e="))
+	if n, ok := a.Int("n"); !ok || n != -42 {
+		t.Fatal(n, ok)
+	}
+	for _, key := range []string{"big", "b", "e", "missing"} {
+		if n, ok := a.Int(key); ok {
+			t.Errorf("%q: %d", key, n)
+		}
+	}
+}
+
+func TestArgsNoAllocs(t *testing.T) {
+	var a Args
+	q := []byte("x=1&y=hello+world&x=2")
+	buf := make([]byte, len(q))
+	var scratch [4][]byte
+	a.Parse(buf) // Grows kvs once
+	allocs := testing.AllocsPerRun(100, func() {
+		copy(buf, q)
+		a.Parse(buf)
+		_ = a.Peek("y")
+		_ = a.PeekMulti(scratch[:0], "x")
+		_, _ = a.Int("x")
+		a.VisitAll(func(key []byte, value []byte) {})
+	})
+	if allocs != 0 {
+		t.Fatal(allocs)
+	}
+}
+
+func TestRequestArgs(t *testing.T) {
+	h := func(wr ResponseWriter, r *Request) {
+		v, _ := r.Args().Int("v")
+		result := fmt.Sprintf("%d|%s|%d", v, r.Args().Peek("s"), r.Args().Len())
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}
+	conn := dial(t, startServer(t, &Server{handler: h}))
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/p?v=7&s=a%20b", "7|a b|2"},
+		{"/p", "0||0"}, // Args of previous request on the connection are not kept
+	} {
+		if _, got := roundTrip(t, conn, "GET "+tc.path+" HTTP/1.1\r\n\r\n"); got != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
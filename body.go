@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+)
+
+const maxChunkLineSize = 1024
+const maxBodyDiscard = 256 * 1024 // Larger unread bodies close connection instead of being read
+
+// Decoded request body may be larger than encoded one by this factor, after decompressionRatioFloor bytes
+const maxDecompressionRatio = 100
+const decompressionRatioFloor = 1024 * 1024
+
+const (
+	CHUNK_SIZE      = iota
+	CHUNK_DATA      = iota
+	CHUNK_DATA_CRLF = iota
+	CHUNK_TRAILER   = iota
+)
+
+var errChunkLineTooLong = errors.New("Chunk line too long")
+var errChunkInvalid = errors.New("Invalid chunk encoding")
+
+var ErrUnsupportedEncoding = errors.New("Unsupported content or transfer coding")
+var ErrDecompressionRatio = errors.New("Request body decompression ratio exceeded")
+
+// bodyReader reads request body, first from incomingBuffer, then from connection.
+// Bytes after body stay in incomingBuffer for the next pipelined request.
+type bodyReader struct {
+	c          *Client
+	remaining  int64 // Of content-length body or current chunk
+	chunked    bool
+	chunkState int
+	err        error // Sticky, io.EOF after body is finished
+
+	expectContinue bool // Send "100 Continue" before the first read
+	bytesRead      int64
+	untilEOF       bool // Response body delimited by connection close
+}
+
+func (b *bodyReader) reset(r *Request) {
+	b.init(r.TransferEncodingChunked, r.ContentLength)
+	if b.err != nil {
+		return
+	}
+	if expect := r.HeaderLower("expect"); len(expect) != 0 { // Compared without lowercasing, handler sees header as received
+		b.expectContinue = bytes.EqualFold(expect, []byte("100-continue")) && r.VersionMinor >= 1
+	}
+}
+
+func (b *bodyReader) init(chunked bool, contentLength int64) {
+	b.remaining = contentLength
+	b.chunked = chunked
+	b.chunkState = CHUNK_SIZE
+	b.err = nil
+	b.bytesRead = 0
+	b.expectContinue = false
+	b.untilEOF = false
+	if !b.chunked && contentLength <= 0 {
+		b.err = io.EOF
+	}
+}
+
+func (b *bodyReader) initUntilEOF() {
+	b.init(false, math.MaxInt64)
+	b.untilEOF = true
+}
+
+// Body returns reader of request body, valid only during handler call, with transfer
+// and content codings decoded. Unread body is discarded after handler returns.
+// Unknown coding is reported by Read as ErrUnsupportedEncoding, so handler can answer 415.
+func (r *Request) Body() io.Reader {
+	if r.decodedBody == nil {
+		r.decodedBody = r.newBody(true)
+	}
+	return r.decodedBody
+}
+
+// RawBody is Body without content-encoding decoding, for handlers which store or forward
+// encoded data as is. Transfer codings are hop-by-hop, so they are decoded anyway.
+// Handler must read either Body or RawBody, not both.
+func (r *Request) RawBody() io.Reader {
+	if r.rawBody == nil {
+		r.rawBody = r.newBody(false)
+	}
+	return r.rawBody
+}
+
+func (r *Request) newBody(decodeContent bool) io.Reader {
+	if r.body == nil {
+		return http.NoBody
+	}
+	var codings [][]byte // In order of application
+	if decodeContent {
+		for _, kv := range r.Headers {
+			if string(kv.key) == "content-encoding" {
+				codings = appendCodings(codings, kv.value)
+			}
+		}
+	}
+	codings = append(codings, r.TransferEncodings...)
+	if len(codings) == 0 {
+		return r.body
+	}
+	return &decodingReader{body: countingReader{r: r.body}, codings: codings}
+}
+
+// appendCodings appends tokens of comma separated list, except identity. Tokens keep their case.
+func appendCodings(codings [][]byte, list []byte) [][]byte {
+	for len(list) != 0 {
+		var coding []byte
+		if comma := bytes.IndexByte(list, ','); comma >= 0 {
+			coding, list = trimSP(list[:comma]), list[comma+1:]
+		} else {
+			coding, list = trimSP(list), nil
+		}
+		if len(coding) != 0 && !bytes.EqualFold(coding, []byte("identity")) {
+			codings = append(codings, coding)
+		}
+	}
+	return codings
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// decodingReader undoes codings in reverse order of application. Decoders are created on the first
+// Read, because gzip reads its header at creation, and that would send "100 Continue" too early.
+type decodingReader struct {
+	body    countingReader
+	codings [][]byte
+	decoder io.Reader
+	decoded int64
+	err     error
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.decoder == nil {
+		if d.decoder, d.err = newDecoder(&d.body, d.codings); d.err != nil {
+			return 0, d.err
+		}
+	}
+	n, err := d.decoder.Read(p)
+	d.decoded += int64(n)
+	if d.decoded > decompressionRatioFloor && d.decoded > d.body.n*maxDecompressionRatio {
+		d.err = ErrDecompressionRatio
+		return 0, d.err
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+func newDecoder(r io.Reader, codings [][]byte) (io.Reader, error) {
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch strings.ToLower(string(codings[i])) {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(r)
+		case "deflate": // zlib format, RFC 9110 section 8.4.1.2
+			r, err = zlib.NewReader(r)
+		default:
+			return nil, ErrUnsupportedEncoding
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF // Empty body is not valid gzip or zlib stream
+			}
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.expectContinue {
+		b.expectContinue = false
+		if err := b.c.writeContinue(); err != nil {
+			b.err = err
+			return 0, err
+		}
+	}
+	n, err := b.read(p)
+	b.bytesRead += int64(n)
+	if err != nil {
+		b.err = err
+		if err == io.EOF {
+			b.c.startBackgroundRead() // If somebody waits on Request.Context
+		}
+		if n != 0 {
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+func (b *bodyReader) read(p []byte) (int, error) {
+	if b.untilEOF {
+		n, err := b.readData(p)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return n, err
+	}
+	if !b.chunked {
+		n, err := b.readData(p)
+		if err == nil && b.remaining == 0 {
+			err = io.EOF
+		}
+		return n, err
+	}
+	for {
+		switch b.chunkState {
+		case CHUNK_SIZE:
+			line, err := b.c.readLine()
+			if err != nil {
+				return 0, err
+			}
+			size, ok := parseChunkSize(line)
+			if !ok {
+				return 0, errChunkInvalid
+			}
+			if size == 0 {
+				b.chunkState = CHUNK_TRAILER
+				continue
+			}
+			b.remaining = size
+			b.chunkState = CHUNK_DATA
+		case CHUNK_DATA:
+			n, err := b.readData(p)
+			if b.remaining == 0 {
+				b.chunkState = CHUNK_DATA_CRLF
+			}
+			return n, err
+		case CHUNK_DATA_CRLF:
+			line, err := b.c.readLine()
+			if err != nil {
+				return 0, err
+			}
+			if len(line) != 0 {
+				return 0, errChunkInvalid
+			}
+			b.chunkState = CHUNK_SIZE
+		case CHUNK_TRAILER:
+			line, err := b.c.readLine()
+			if err != nil {
+				return 0, err
+			}
+			if len(line) == 0 {
+				return 0, io.EOF
+			}
+			// Trailer fields are ignored
+		}
+	}
+}
+
+// readData reads not more than b.remaining bytes
+func (b *bodyReader) readData(p []byte) (int, error) {
+	c := b.c
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.incomingReadPos == c.incomingWritePos {
+		c.incomingReadPos = c.bodyStart // Header before bodyStart is still in use
+		c.incomingWritePos = c.bodyStart
+		if len(p) >= len(c.incomingBuffer)-c.bodyStart { // Large reads bypass buffer
+			n, err := c.incomingReader.Read(p)
+			b.remaining -= int64(n)
+			if err == io.EOF && b.remaining != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		if err := c.readMore(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, c.incomingBuffer[c.incomingReadPos:c.incomingWritePos])
+	c.incomingReadPos += n
+	b.remaining -= int64(n)
+	return n, nil
+}
+
+// discard reads the rest of body, so the next request can be parsed.
+// Returns false if connection must be closed instead.
+func (b *bodyReader) discard() bool {
+	if b.err == io.EOF {
+		return true
+	}
+	if b.err != nil || b.expectContinue { // Client waits for our decision, so will not send body
+		return false
+	}
+	var scratch [512]byte
+	for b.bytesRead < maxBodyDiscard {
+		_, err := b.Read(scratch[:])
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+func parseChunkSize(line []byte) (int64, bool) {
+	if ext := bytes.IndexByte(line, ';'); ext >= 0 {
+		line = line[:ext] // Chunk extensions are ignored
+	}
+	line = trimSP(line)
+	if len(line) == 0 || len(line) > 15 {
+		return 0, false
+	}
+	var size int64
+	for _, c := range line {
+		digit := fromHexDigit(c)
+		if digit < 0 {
+			return 0, false
+		}
+		size = size*16 + int64(digit)
+	}
+	return size, true
+}
+
+// readLine returns line without CRLF from incomingBuffer, reading more if needed
+func (c *Client) readLine() ([]byte, error) {
+	for {
+		ib := c.incomingBuffer[c.incomingReadPos:c.incomingWritePos]
+		if np := bytes.IndexByte(ib, '\n'); np >= 0 {
+			c.incomingReadPos += np + 1
+			line := ib[:np]
+			if len(line) != 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			return line, nil
+		}
+		if len(ib) >= maxChunkLineSize {
+			return nil, errChunkLineTooLong
+		}
+		if c.incomingWritePos == len(c.incomingBuffer) { // Defragment, keeping header before bodyStart
+			c.incomingWritePos = c.bodyStart + copy(c.incomingBuffer[c.bodyStart:], ib)
+			c.incomingReadPos = c.bodyStart
+		}
+		if err := c.readMore(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) writeContinue() error {
+	if c.writerState != CONNECTION_EXPECT_STATUS {
+		return nil // Handler already decided
+	}
+	_, err := c.conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	return err
+}
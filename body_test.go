@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Body larger than incomingBuffer must not overwrite request line and headers which Request points to
+func TestBodyLargerThanBufferKeepsHeader(t *testing.T) {
+	h := func(wr ResponseWriter, r *Request) {
+		b, err := io.ReadAll(r.Body())
+		result := fmt.Sprintf("%s %s %s %s %d %v", r.Path, r.QueryString, r.Host, r.HeaderLower("x-tag"), len(b), err)
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}
+	conn := dial(t, startServer(t, &Server{handler: h}))
+	body := strings.Repeat("A", 5*incomingBufferSize)
+	want := fmt.Sprintf("/some/path q=1 example.com tag %d <nil>", len(body))
+	for _, framing := range []string{
+		fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body),
+		fmt.Sprintf("Transfer-Encoding: chunked\r\n\r\n%x\r\n%s\r\n0\r\n\r\n", len(body), body),
+		fmt.Sprintf("Transfer-Encoding: chunked\r\n\r\n%s0\r\n\r\n", strings.Repeat("a\r\nAAAAAAAAAA\r\n", len(body)/10)),
+	} {
+		_, got := roundTrip(t, conn, "POST /some/path?q=1 HTTP/1.1\r\nHost: example.com\r\nX-Tag: tag\r\n"+framing)
+		if got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestBodyPipelinedRequests(t *testing.T) {
+	h := func(wr ResponseWriter, r *Request) {
+		b, _ := io.ReadAll(r.Body())
+		result := string(r.Path) + ":" + string(b)
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}
+	conn := dial(t, startServer(t, &Server{handler: h}))
+	var reqs strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&reqs, "POST /%d HTTP/1.1\r\nContent-Length: 3\r\n\r\nb%02d", i, i)
+	}
+	if _, err := io.WriteString(conn, reqs.String()); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	for i := 0; i < 50; i++ {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		if want := fmt.Sprintf("/%d:b%02d", i, i); string(b) != want {
+			t.Fatalf("got %q, want %q", b, want)
+		}
+	}
+}
+
+func gzipBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(b)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+func zlibBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	_, _ = w.Write(b)
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+func oneChunk(b []byte) string {
+	return fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(b), b)
+}
+
+// decodeHandler echoes decoded body, or RawBody for /raw, and content-encoding header as received
+func decodeHandler(wr ResponseWriter, r *Request) {
+	body := r.Body()
+	if string(r.Path) == "/raw" {
+		body = r.RawBody()
+	}
+	b, err := io.ReadAll(body)
+	switch {
+	case errors.Is(err, ErrUnsupportedEncoding):
+		writeSimpleResponse(wr, 415, "")
+	case errors.Is(err, ErrDecompressionRatio):
+		writeSimpleResponse(wr, 413, "")
+	case err != nil:
+		writeSimpleResponse(wr, 400, "")
+	default:
+		wr.WriteOtherHeader("x-content-encoding", string(r.HeaderLower("content-encoding")))
+		wr.WriteContentLength(int64(len(b)))
+		_, _ = wr.Write(b)
+	}
+}
+
+func TestBodyContentDecoding(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: decodeHandler}))
+	text := []byte(strings.Repeat("payload ", 100))
+	for _, tc := range []struct {
+		path     string
+		encoding string
+		body     []byte
+		want     []byte
+	}{
+		{"/", "gzip", gzipBytes(text), text},
+		{"/", "x-gzip", gzipBytes(text), text},
+		{"/", "deflate", zlibBytes(text), text},
+		{"/", "Deflate, GZIP", gzipBytes(zlibBytes(text)), text},
+		{"/", "identity", text, text},
+		{"/", "Identity, gzip", gzipBytes(text), text},
+		{"/raw", "gzip", gzipBytes(text), gzipBytes(text)},
+	} {
+		resp, got := roundTrip(t, conn, fmt.Sprintf("POST %s HTTP/1.1\r\nContent-Length: %d\r\nContent-Encoding: %s\r\n\r\n%s", tc.path, len(tc.body), tc.encoding, tc.body))
+		if resp.StatusCode != 200 || got != string(tc.want) {
+			t.Fatalf("%s %q: %d, %d bytes", tc.path, tc.encoding, resp.StatusCode, len(got))
+		}
+		if header := resp.Header.Get("X-Content-Encoding"); header != tc.encoding { // Not lowercased in place
+			t.Fatalf("%q seen by handler as %q", tc.encoding, header)
+		}
+	}
+}
+
+func TestBodyDecodingErrors(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: decodeHandler}))
+	text := []byte(strings.Repeat("payload ", 100))
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+		want     int
+	}{
+		{"br", text, 415},
+		{"gzip", text, 400},
+		{"gzip", nil, 400},
+		{"gzip", gzipBytes(make([]byte, 4*decompressionRatioFloor)), 413},
+	} {
+		resp, _ := roundTrip(t, conn, fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\nContent-Encoding: %s\r\n\r\n%s", len(tc.body), tc.encoding, tc.body))
+		if resp.StatusCode != tc.want {
+			t.Fatalf("%q with %d bytes: got %d, want %d", tc.encoding, len(tc.body), resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestBodyTransferDecoding(t *testing.T) {
+	addr := startServer(t, &Server{handler: decodeHandler})
+	conn := dial(t, addr)
+	text := []byte(strings.Repeat("payload ", 100))
+	// Transfer coding is hop-by-hop, so RawBody decodes it too
+	resp, got := roundTrip(t, conn, "POST /raw HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n"+oneChunk(gzipBytes(text)))
+	if resp.StatusCode != 200 || got != string(text) {
+		t.Fatalf("%d, %d bytes", resp.StatusCode, len(got))
+	}
+	resp, got = roundTrip(t, conn, "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\nContent-Encoding: gzip\r\n\r\n"+oneChunk(gzipBytes(gzipBytes(text))))
+	if resp.StatusCode != 200 || got != string(text) {
+		t.Fatalf("%d, %d bytes", resp.StatusCode, len(got))
+	}
+	for _, framing := range []string{
+		"Transfer-Encoding: chunked, gzip\r\n",
+		"Transfer-Encoding: gzip\r\n",
+		"Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n",
+	} {
+		conn := dial(t, addr)
+		_, _ = io.WriteString(conn, "POST / HTTP/1.1\r\n"+framing+"\r\n"+oneChunk(text))
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err := conn.Read(make([]byte, 100)); err != io.EOF {
+			t.Fatalf("%q: %d bytes, %v", framing, n, err)
+		}
+	}
+}
+
+func TestBodyExpectContinueCaseInsensitive(t *testing.T) {
+	h := func(wr ResponseWriter, r *Request) {
+		b, _ := io.ReadAll(r.Body())
+		result := string(r.HeaderLower("expect")) + ":" + string(b)
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}
+	conn := dial(t, startServer(t, &Server{handler: h}))
+	_, _ = io.WriteString(conn, "POST / HTTP/1.1\r\nContent-Length: 4\r\nExpect: 100-Continue\r\n\r\n")
+	br := bufio.NewReader(conn)
+	if line, err := br.ReadString('\n'); err != nil || line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("%q, %v", line, err)
+	}
+	if line, _ := br.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("%q", line)
+	}
+	_, _ = io.WriteString(conn, "body")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(resp.Body); string(b) != "100-Continue:body" {
+		t.Fatalf("%q", b)
+	}
+}
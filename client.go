@@ -0,0 +1,446 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTPClient sends HTTP/1.1 requests, parsing responses in place with the same machinery
+// as server, and keeps idle connections per address for reuse.
+type HTTPClient struct {
+	Dial                  func(network string, addr string) (net.Conn, error) // nil means net.DialTimeout
+	DialTimeout           time.Duration                                       // 0 means defaultDialTimeout
+	Timeout               time.Duration                                       // Of the whole exchange including body, 0 means none
+	MaxIdleConnsPerHost   int                                                 // 0 means defaultMaxIdleConnsPerHost
+	IdleTimeout           time.Duration                                       // 0 means defaultIdleTimeout
+	MaxResponseHeaderSize int                                                 // 0 means defaultMaxResponseHeaderSize
+
+	mu   sync.Mutex
+	idle map[string][]*clientConn // Newest last
+}
+
+const defaultDialTimeout = 10 * time.Second
+const defaultMaxIdleConnsPerHost = 4
+const defaultIdleTimeout = 90 * time.Second
+const defaultMaxResponseHeaderSize = 16 * 1024 // Responses carry more than requests, like several set-cookie headers
+
+var errRequestInvalid = errors.New("Invalid request method, path or header")
+var errRequestTooLarge = errors.New("Request header too large")
+var errRequestBodyLength = errors.New("Request body length differs from ContentLength")
+var errResponseClosed = errors.New("Response already closed")
+
+// ClientRequest is sent by HTTPClient.Do
+type ClientRequest struct {
+	Addr          string    // host:port to connect to
+	Method        string    // GET if empty
+	Path          string    // With query string, already percent-encoded, "/" if empty
+	Host          string    // Host header, Addr if empty
+	Body          io.Reader // nil for no body
+	ContentLength int64     // If Body is set, 0 means unknown length, sent chunked
+
+	headers []HeaderKV
+}
+
+// AddHeader adds request header. Host, content-length, transfer-encoding and connection are
+// written by client and must not be added.
+func (req *ClientRequest) AddHeader(key string, value string) {
+	req.headers = append(req.headers, HeaderKV{key: []byte(key), value: []byte(value)})
+}
+
+// Response header slices point into connection buffer, so are valid until Close
+type Response struct {
+	StatusCode        int
+	Reason            []byte
+	VersionMajor      int
+	VersionMinor      int
+	KeepAlive         bool
+	ContentLength     int64 // -1 if not specified
+	ContentTypeMime   []byte
+	ContentTypeSuffix []byte
+
+	TransferEncodings       [][]byte
+	TransferEncodingChunked bool
+	Headers                 []HeaderKV
+	ConnectionTokens        [][]byte
+	HopByHopHeaders         []HeaderKV
+
+	cc     *clientConn
+	noBody bool
+}
+
+type clientConn struct {
+	c         Client // Buffers, response parser and body reader, response headers go to c.request
+	hc        *HTTPClient
+	addr      string
+	response  Response
+	idleSince time.Time
+	reused    bool
+}
+
+// isIdempotent tells if request can be safely sent again after connection failure
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Do sends request and reads response header. Caller must Close response.
+func (hc *HTTPClient) Do(req *ClientRequest) (*Response, error) {
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	for {
+		cc, err := hc.getConn(req.Addr)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := cc.roundTrip(req, method)
+		if err == nil {
+			return resp, nil
+		}
+		_ = cc.c.conn.Close()
+		// Server could close idle connection before it got our request, so try once more on a new one
+		if !cc.reused || cc.c.incomingWritePos != 0 || req.Body != nil || !isIdempotent(method) {
+			return nil, err
+		}
+	}
+}
+
+// CloseIdleConnections closes connections kept for reuse
+func (hc *HTTPClient) CloseIdleConnections() {
+	hc.mu.Lock()
+	idle := hc.idle
+	hc.idle = nil
+	hc.mu.Unlock()
+	for _, conns := range idle {
+		for _, cc := range conns {
+			_ = cc.c.conn.Close()
+		}
+	}
+}
+
+func (hc *HTTPClient) idleTimeout() time.Duration {
+	if hc.IdleTimeout > 0 {
+		return hc.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func (hc *HTTPClient) getConn(addr string) (*clientConn, error) {
+	now := time.Now()
+	hc.mu.Lock()
+	for conns := hc.idle[addr]; len(conns) != 0; conns = hc.idle[addr] {
+		cc := conns[len(conns)-1]
+		hc.idle[addr] = conns[:len(conns)-1]
+		if now.Sub(cc.idleSince) < hc.idleTimeout() {
+			hc.mu.Unlock()
+			cc.reused = true
+			return cc, nil
+		}
+		_ = cc.c.conn.Close()
+	}
+	hc.mu.Unlock()
+	var conn net.Conn
+	var err error
+	if hc.Dial != nil {
+		conn, err = hc.Dial("tcp", addr)
+	} else {
+		dialTimeout := hc.DialTimeout
+		if dialTimeout <= 0 {
+			dialTimeout = defaultDialTimeout
+		}
+		conn, err = net.DialTimeout("tcp", addr, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cc := &clientConn{hc: hc, addr: addr}
+	cc.c.conn = conn
+	cc.c.rawConn = conn
+	cc.c.headerLimit = hc.MaxResponseHeaderSize
+	if cc.c.headerLimit <= 0 {
+		cc.c.headerLimit = defaultMaxResponseHeaderSize
+	}
+	cc.c.incomingBuffer = make([]byte, cc.c.headerLimit+incomingBufferSize) // Body needs room after header
+	cc.c.incomingReader = conn
+	cc.c.outgoingBuffer = make([]byte, outgoingBufferSize)
+	cc.c.startTime = now
+	cc.c.body.c = &cc.c
+	return cc, nil
+}
+
+func (hc *HTTPClient) putConn(cc *clientConn) {
+	maxIdle := hc.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleConnsPerHost
+	}
+	cc.idleSince = time.Now()
+	_ = cc.c.conn.SetDeadline(time.Time{})
+	hc.mu.Lock()
+	if hc.idle == nil {
+		hc.idle = map[string][]*clientConn{}
+	}
+	if len(hc.idle[cc.addr]) < maxIdle {
+		hc.idle[cc.addr] = append(hc.idle[cc.addr], cc)
+		cc = nil
+	}
+	hc.mu.Unlock()
+	if cc != nil {
+		_ = cc.c.conn.Close()
+	}
+}
+
+// validRequestByte rejects bytes which could split request line or header
+func validRequestByte(b byte, allowSP bool) bool {
+	return b != '\r' && b != '\n' && b != 0 && (allowSP || !isSP(b))
+}
+
+func validRequestString(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if !validRequestByte(str[i], false) {
+			return false
+		}
+	}
+	return len(str) != 0
+}
+
+func validRequestHeader(kv HeaderKV) bool {
+	for _, b := range kv.key {
+		if !validRequestByte(b, false) {
+			return false
+		}
+	}
+	for _, b := range kv.value {
+		if !validRequestByte(b, true) {
+			return false
+		}
+	}
+	return len(kv.key) != 0
+}
+
+// writeHeaderLine flushes if needed, so header is limited by outgoingBuffer size only
+func (c *Client) writeHeaderLine(key []byte, value []byte) error {
+	if err := c.ensureSpace(len(key) + len(value) + 4); err != nil {
+		return err
+	}
+	if c.outgoingWritePos+len(key)+len(value)+4 > len(c.outgoingBuffer) {
+		return errRequestTooLarge
+	}
+	c.write(key)
+	c.writeString(": ")
+	c.write(value)
+	c.writeString("\r\n")
+	return nil
+}
+
+func (cc *clientConn) roundTrip(req *ClientRequest, method string) (*Response, error) {
+	c := &cc.c
+	if cc.hc.Timeout > 0 {
+		_ = c.conn.SetDeadline(time.Now().Add(cc.hc.Timeout))
+	}
+	if err := cc.writeRequest(req, method); err != nil {
+		return nil, err
+	}
+	resp := &cc.response
+	for {
+		if err := cc.readResponse(resp); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == 101 {
+			break
+		}
+		// Informational responses before the final one are skipped
+	}
+	resp.cc = cc
+	r := &c.request
+	resp.noBody = method == "HEAD" || statusWithoutBody(resp.StatusCode)
+	switch {
+	case resp.noBody:
+		c.body.init(false, 0)
+	case r.TransferEncodingChunked:
+		c.body.init(true, -1)
+	case r.ContentLength >= 0:
+		c.body.init(false, r.ContentLength)
+	default:
+		c.body.initUntilEOF()
+		resp.KeepAlive = false
+	}
+	return resp, nil
+}
+
+func (cc *clientConn) writeRequest(req *ClientRequest, method string) error {
+	c := &cc.c
+	path := req.Path
+	if path == "" {
+		path = "/"
+	}
+	host := req.Host
+	if host == "" {
+		host = req.Addr
+	}
+	if !validRequestString(method) || !validRequestString(path) || !validRequestString(host) {
+		return errRequestInvalid
+	}
+	c.outgoingWritePos = 0
+	if len(method)+len(path)+len(host)+32 > len(c.outgoingBuffer) {
+		return errRequestTooLarge
+	}
+	c.writeString(method)
+	c.writeByte(' ')
+	c.writeString(path)
+	c.writeString(" HTTP/1.1\r\nhost: ")
+	c.writeString(host)
+	c.writeString("\r\n")
+	for _, kv := range req.headers {
+		if !validRequestHeader(kv) {
+			return errRequestInvalid
+		}
+		if err := c.writeHeaderLine(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+	chunked := req.Body != nil && req.ContentLength <= 0
+	if err := c.ensureSpace(192); err != nil { // writeUint needs 128 bytes of scratch space
+		return err
+	}
+	if chunked {
+		c.writeString("transfer-encoding: chunked\r\n")
+	} else if req.Body != nil {
+		c.writeString("content-length: ")
+		c.writeUint(uint(req.ContentLength))
+		c.writeString("\r\n")
+	} else if method == "POST" || method == "PUT" || method == "PATCH" {
+		c.writeString("content-length: 0\r\n")
+	}
+	c.writeString("\r\n")
+	if req.Body != nil {
+		if err := c.writeRequestBody(req.Body, chunked, req.ContentLength); err != nil {
+			return err
+		}
+	}
+	return c.flush()
+}
+
+// writeRequestBody reads body directly into outgoingBuffer, leaving room for chunk header
+func (c *Client) writeRequestBody(body io.Reader, chunked bool, contentLength int64) error {
+	const minRead = 512
+	var written int64
+	for {
+		if err := c.ensureSpace(maxChunkHeaderSize + minRead + 2); err != nil {
+			return err
+		}
+		dataStart := c.outgoingWritePos
+		if chunked {
+			dataStart += maxChunkHeaderSize
+		}
+		n, err := body.Read(c.outgoingBuffer[dataStart : len(c.outgoingBuffer)-2])
+		if n != 0 {
+			written += int64(n)
+			if chunked {
+				c.writeHex(uint(n))
+				c.writeString("\r\n")
+				c.outgoingWritePos += copy(c.outgoingBuffer[c.outgoingWritePos:], c.outgoingBuffer[dataStart:dataStart+n])
+				c.writeString("\r\n")
+			} else {
+				c.outgoingWritePos += n
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !chunked && written > contentLength {
+			return errRequestBodyLength
+		}
+	}
+	if chunked {
+		if err := c.ensureSpace(5); err != nil {
+			return err
+		}
+		c.writeString("0\r\n\r\n")
+		return nil
+	}
+	if written != contentLength {
+		return errRequestBodyLength
+	}
+	return nil
+}
+
+func (cc *clientConn) readResponse(resp *Response) error {
+	c := &cc.c
+	r := &c.request
+	r.ContentLength = -1
+	r.ContentTypeMime = nil
+	r.ContentTypeSuffix = nil
+	r.TransferEncodings = r.TransferEncodings[:0]
+	r.TransferEncodingChunked = false
+	r.Headers = r.Headers[:0]
+	r.ConnectionTokens = r.ConnectionTokens[:0]
+	r.HopByHopHeaders = r.HopByHopHeaders[:0]
+	r.ConnectionUpgrade = false
+	r.UpgradeProtocols = r.UpgradeProtocols[:0]
+	if err := c.readComplete(); err != nil {
+		return err
+	}
+	if str := c.parseResponse2(resp); str != "" {
+		return errors.New(str)
+	}
+	c.bodyStart = c.incomingReadPos
+	if len(r.TransferEncodings) != 0 {
+		return errors.New("Transfer codings other than chunked are not supported")
+	}
+	r.stripHopByHopHeaders()
+	resp.VersionMajor = r.VersionMajor
+	resp.VersionMinor = r.VersionMinor
+	resp.KeepAlive = r.KeepAlive
+	resp.ContentLength = r.ContentLength
+	resp.ContentTypeMime = r.ContentTypeMime
+	resp.ContentTypeSuffix = r.ContentTypeSuffix
+	resp.TransferEncodings = r.TransferEncodings
+	resp.TransferEncodingChunked = r.TransferEncodingChunked
+	resp.Headers = r.Headers
+	resp.ConnectionTokens = r.ConnectionTokens
+	resp.HopByHopHeaders = r.HopByHopHeaders
+	return nil
+}
+
+// Header returns value of the last header with lowerKey, nil if not found
+func (resp *Response) Header(lowerKey string) []byte {
+	for i := len(resp.Headers) - 1; i >= 0; i-- {
+		if string(resp.Headers[i].key) == lowerKey {
+			return resp.Headers[i].value
+		}
+	}
+	return nil
+}
+
+// Body returns reader of response body, valid until Close
+func (resp *Response) Body() io.Reader {
+	if resp.cc == nil || resp.noBody {
+		return http.NoBody
+	}
+	return &resp.cc.c.body
+}
+
+// Close discards the rest of body and returns connection for reuse if possible
+func (resp *Response) Close() error {
+	cc := resp.cc
+	if cc == nil {
+		return errResponseClosed
+	}
+	resp.cc = nil
+	if resp.KeepAlive && resp.StatusCode != 101 && cc.c.body.discard() {
+		cc.hc.putConn(cc)
+		return nil
+	}
+	return cc.c.conn.Close()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testUpstream is net/http server counting connections
+func testUpstream(t *testing.T, conns *int32) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/chunked":
+			_, _ = w.Write([]byte("part1"))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte("part2"))
+		case "/close":
+			conn, buf, _ := w.(http.Hijacker).Hijack()
+			_, _ = buf.WriteString("HTTP/1.0 200 OK\r\nX-A: 1\r\n\r\nuntil eof")
+			_ = buf.Flush()
+			_ = conn.Close()
+		case "/cookies":
+			for i := 0; i < 100; i++ {
+				w.Header().Add("Set-Cookie", fmt.Sprintf("cookie%d=%s", i, strings.Repeat("c", 100)))
+			}
+			_, _ = w.Write(bytes.Repeat([]byte("b"), 100000))
+		default:
+			w.Header().Set("X-Echo", r.Header.Get("X-In"))
+			w.Header().Set("Content-Type", "text/Plain; charset=utf-8")
+			fmt.Fprintf(w, "%s %s %s te=%v cl=%d", r.Method, r.URL.RequestURI(), b, r.TransferEncoding, r.ContentLength)
+		}
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew && conns != nil {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// doRequest returns response with the whole body read, caller must Close it
+func doRequest(t *testing.T, hc *HTTPClient, req *ClientRequest) (*Response, string) {
+	t.Helper()
+	resp, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestHTTPClientReusesConnection(t *testing.T) {
+	var conns int32
+	addr := testUpstream(t, &conns).Listener.Addr().String()
+	hc := &HTTPClient{}
+	for i := 0; i < 3; i++ {
+		req := &ClientRequest{Addr: addr, Path: "/a?b=c"}
+		req.AddHeader("X-In", "hello")
+		resp, body := doRequest(t, hc, req)
+		if resp.StatusCode != 200 || body != "GET /a?b=c  te=[] cl=0" || string(resp.Header("x-echo")) != "hello" || string(resp.ContentTypeMime) != "text/plain" {
+			t.Fatal(resp.StatusCode, body, resp.Headers)
+		}
+		resp.Close()
+	}
+	resp, body := doRequest(t, hc, &ClientRequest{Addr: addr, Method: "HEAD", Path: "/"})
+	if body != "" || resp.StatusCode != 200 {
+		t.Fatal(body)
+	}
+	resp.Close()
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatal("connections", n)
+	}
+}
+
+func TestHTTPClientBodies(t *testing.T) {
+	addr := testUpstream(t, nil).Listener.Addr().String()
+	hc := &HTTPClient{}
+	resp, body := doRequest(t, hc, &ClientRequest{Addr: addr, Method: "POST", Path: "/p", Body: strings.NewReader("xyz"), ContentLength: 3})
+	if body != "POST /p xyz te=[] cl=3" {
+		t.Fatal(body)
+	}
+	resp.Close()
+	big := strings.Repeat("q", 10000)
+	resp, body = doRequest(t, hc, &ClientRequest{Addr: addr, Method: "PUT", Path: "/p", Body: strings.NewReader(big)})
+	if body != "PUT /p "+big+" te=[chunked] cl=-1" {
+		t.Fatal(len(body))
+	}
+	resp.Close()
+	resp, body = doRequest(t, hc, &ClientRequest{Addr: addr, Path: "/chunked"})
+	if body != "part1part2" || !resp.TransferEncodingChunked {
+		t.Fatal(body)
+	}
+	resp.Close()
+	resp, body = doRequest(t, hc, &ClientRequest{Addr: addr, Path: "/close"})
+	if body != "until eof" || resp.KeepAlive || string(resp.Header("x-a")) != "1" {
+		t.Fatal(body, resp.KeepAlive)
+	}
+	resp.Close()
+}
+
+func TestHTTPClientLargeResponseHeader(t *testing.T) {
+	addr := testUpstream(t, nil).Listener.Addr().String()
+	resp, body := doRequest(t, &HTTPClient{}, &ClientRequest{Addr: addr, Path: "/cookies"})
+	defer resp.Close()
+	if len(body) != 100000 {
+		t.Fatal(len(body))
+	}
+	// Header is still valid after body larger than buffer was read
+	var cookies int
+	for _, kv := range resp.Headers {
+		if string(kv.key) == "set-cookie" && string(kv.value) == fmt.Sprintf("cookie%d=%s", cookies, strings.Repeat("c", 100)) {
+			cookies++
+		}
+	}
+	if cookies != 100 {
+		t.Fatal(cookies)
+	}
+	if _, err := (&HTTPClient{MaxResponseHeaderSize: 4096}).Do(&ClientRequest{Addr: addr, Path: "/cookies"}); err == nil {
+		t.Fatal("header over limit")
+	}
+}
+
+func TestHTTPClientRetriesStaleConnection(t *testing.T) {
+	ts := testUpstream(t, nil)
+	addr := ts.Listener.Addr().String()
+	hc := &HTTPClient{}
+	resp, _ := doRequest(t, hc, &ClientRequest{Addr: addr, Path: "/x"})
+	resp.Close()
+	ts.CloseClientConnections()
+	resp, body := doRequest(t, hc, &ClientRequest{Addr: addr, Path: "/x"})
+	if !strings.HasPrefix(body, "GET /x") {
+		t.Fatal(body)
+	}
+	resp.Close()
+}
+
+func TestHTTPClientRejectsInvalidRequest(t *testing.T) {
+	addr := testUpstream(t, nil).Listener.Addr().String()
+	hc := &HTTPClient{}
+	for _, req := range []*ClientRequest{
+		{Addr: addr, Path: "/a\r\nX: y"},
+		{Addr: addr, Path: "/a b"},
+		{Addr: addr, Method: "GE T"},
+		{Addr: addr, Host: "a\nb"},
+	} {
+		if _, err := hc.Do(req); err != errRequestInvalid {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHTTPClientAgainstServer(t *testing.T) {
+	addr := startServer(t, &Server{handler: func(wr ResponseWriter, r *Request) {
+		b, _ := io.ReadAll(r.Body())
+		_, _ = wr.Write(bytes.ToUpper(b))
+	}})
+	hc := &HTTPClient{}
+	for i := 0; i < 3; i++ {
+		resp, body := doRequest(t, hc, &ClientRequest{Addr: addr, Method: "POST", Body: strings.NewReader("abc")})
+		if body != "ABC" || string(resp.Header("server")) != "crab" {
+			t.Fatal(body)
+		}
+		resp.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Clock is used for date header, can be replaced by a fake in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+var ErrServerClosed = errors.New("Server closed")
+
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+// refreshDate formats date once, so responses only copy bytes
+func (s *Server) refreshDate() {
+	s.date.Store(appendTime(nil, s.now()))
+}
+
+func (s *Server) dateBuffer() []byte {
+	if date, ok := s.date.Load().([]byte); ok {
+		return date
+	}
+	return appendTime(nil, s.now()) // Handler called without serve, for example in tests
+}
+
+func (s *Server) startClock() {
+	s.clockOnce.Do(func() {
+		s.refreshDate()
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.refreshDate()
+				case <-s.closed():
+					return
+				}
+			}
+		}()
+	})
+}
+
+func (s *Server) closed() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+func (s *Server) isClosed() bool {
+	select {
+	case <-s.closed():
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops listener and date clock and cancels request contexts. Active connections are not closed.
+func (s *Server) Close() error {
+	done := s.closed()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-done:
+		return nil
+	default:
+	}
+	close(done)
+	if s.ctx == nil { // So contexts created after Close are cancelled too
+		s.ctx, s.ctxCancel = context.WithCancel(context.Background())
+	}
+	s.ctxCancel()
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
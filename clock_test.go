@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
+
+func TestDateHeaderFromClock(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 11, 15, 12, 45, 26, 0, time.FixedZone("CET", 3600))}
+	s := &Server{Clock: clock, handler: okHandler}
+	conn := dial(t, startServer(t, s))
+	if resp, _ := roundTrip(t, conn, "GET / HTTP/1.1\r\n\r\n"); resp.Header.Get("Date") != "Sun, 15 Nov 2020 11:45:26 GMT" {
+		t.Fatal(resp.Header.Get("Date"))
+	}
+	clock.advance(time.Hour)
+	s.refreshDate() // Instead of waiting for ticker
+	if resp, _ := roundTrip(t, conn, "GET / HTTP/1.1\r\n\r\n"); resp.Header.Get("Date") != "Sun, 15 Nov 2020 12:45:26 GMT" {
+		t.Fatal(resp.Header.Get("Date"))
+	}
+}
+
+func TestServerCloseStopsServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{handler: okHandler}
+	served := make(chan error)
+	go func() { served <- s.serve(l, nil) }()
+	roundTrip(t, dial(t, l.Addr().String()), "GET / HTTP/1.1\r\n\r\n")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil { // Second close does nothing
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	ENCODING_IDENTITY = iota
+	ENCODING_GZIP     = iota
+	ENCODING_DEFLATE  = iota
+)
+
+const defaultCompressMinSize = 1024
+
+// Only encodings from standard library, there is no brotli or zstd encoder there
+var encodingNames = [...]string{ENCODING_IDENTITY: "identity", ENCODING_GZIP: "gzip", ENCODING_DEFLATE: "deflate"}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return w
+}}
+
+// "deflate" of HTTP is zlib format, RFC 9110 section 8.4.1.2
+var zlibWriters = sync.Pool{New: func() interface{} {
+	return zlib.NewWriter(nil)
+}}
+
+// Compress is middleware compressing responses with gzip or deflate, chosen by Accept-Encoding.
+// Bodies smaller than minSize (0 means defaultCompressMinSize) are sent as is, so are responses
+// without content-type, with already compressed content-type, with content-encoding or content-range.
+// Compressed body is chunked, because its length is not known in advance.
+func Compress(minSize int) Middleware {
+	if minSize <= 0 {
+		minSize = defaultCompressMinSize
+	}
+	return func(next Handler) Handler {
+		return func(wr ResponseWriter, r *Request) {
+			if string(r.Method) == "HEAD" {
+				next(wr, r)
+				return
+			}
+			w := compressWriter{ResponseWriter: wr, encoding: acceptedEncoding(r), minSize: minSize, contentLength: -1}
+			defer w.release()
+			next(&w, r)
+			if err := w.finish(); err != nil {
+				panic(http.ErrAbortHandler)
+			}
+		}
+	}
+}
+
+// acceptedEncoding returns encoding with highest q-value from all accept-encoding headers, gzip wins ties
+func acceptedEncoding(r *Request) int {
+	var q [len(encodingNames)]int // Thousandths, -1 means not mentioned
+	for i := range q {
+		q[i] = -1
+	}
+	wildcard := -1
+	for _, kv := range r.Headers {
+		if string(kv.key) != "accept-encoding" {
+			continue
+		}
+		list := kv.value
+		for len(list) != 0 {
+			var item []byte
+			if comma := bytes.IndexByte(list, ','); comma >= 0 {
+				item, list = list[:comma], list[comma+1:]
+			} else {
+				item, list = list, nil
+			}
+			name, weight := parseQItem(item)
+			switch strings.ToLower(string(name)) {
+			case "gzip", "x-gzip":
+				q[ENCODING_GZIP] = weight
+			case "deflate":
+				q[ENCODING_DEFLATE] = weight
+			case "*":
+				wildcard = weight
+			}
+		}
+	}
+	best, bestQ := ENCODING_IDENTITY, 0
+	for enc := ENCODING_GZIP; enc < len(q); enc++ {
+		weight := q[enc]
+		if weight < 0 {
+			weight = wildcard
+		}
+		if weight > bestQ {
+			best, bestQ = enc, weight
+		}
+	}
+	return best
+}
+
+// parseQItem splits "token;q=0.5" into token and q-value in thousandths, invalid q-value means 0
+func parseQItem(item []byte) ([]byte, int) {
+	name := item
+	params := []byte(nil)
+	if semi := bytes.IndexByte(item, ';'); semi >= 0 {
+		name, params = item[:semi], item[semi+1:]
+	}
+	name = trimSP(name)
+	weight := 1000
+	for len(params) != 0 {
+		var param []byte
+		if semi := bytes.IndexByte(params, ';'); semi >= 0 {
+			param, params = trimSP(params[:semi]), params[semi+1:]
+		} else {
+			param, params = trimSP(params), nil
+		}
+		if len(param) < 2 || (param[0] != 'q' && param[0] != 'Q') || param[1] != '=' {
+			continue
+		}
+		weight = parseQValue(param[2:])
+	}
+	return name, weight
+}
+
+// parseQValue parses "0", "0.5", "1.000" and so on, RFC 7231 section 5.3.1
+func parseQValue(b []byte) int {
+	if len(b) == 0 || len(b) > 5 || (b[0] != '0' && b[0] != '1') {
+		return 0
+	}
+	weight := int(b[0]-'0') * 1000
+	if len(b) == 1 {
+		return weight
+	}
+	if b[1] != '.' {
+		return 0
+	}
+	scale := 100
+	for _, c := range b[2:] {
+		if !isDigit(c) {
+			return 0
+		}
+		weight += int(c-'0') * scale
+		scale /= 10
+	}
+	if weight > 1000 {
+		return 0
+	}
+	return weight
+}
+
+// isCompressibleType tells if content of mime type would shrink, known compressed formats would not
+func isCompressibleType(contentType string) bool {
+	mime := contentType
+	if semi := strings.IndexByte(mime, ';'); semi >= 0 {
+		mime = mime[:semi]
+	}
+	mime = strings.ToLower(strings.TrimSpace(mime))
+	switch {
+	case mime == "":
+		return false
+	case mime == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mime, "image/"), strings.HasPrefix(mime, "video/"), strings.HasPrefix(mime, "audio/"),
+		strings.HasPrefix(mime, "font/woff"):
+		return false
+	}
+	switch mime {
+	case "application/gzip", "application/x-gzip", "application/zip", "application/zstd", "application/x-bzip2",
+		"application/x-xz", "application/x-7z-compressed", "application/x-rar-compressed", "application/pdf",
+		"application/octet-stream", "multipart/byteranges":
+		return false
+	}
+	return true
+}
+
+// compressWriter holds back content-length and etag until it knows if body is compressed,
+// which is at minSize bytes, Flush or handler return. Other headers pass through.
+type compressWriter struct {
+	ResponseWriter
+
+	encoding      int
+	minSize       int
+	statusCode    int
+	contentLength int64
+	etag          string
+	compressible  bool // content-type seen and compressible
+	skip          bool // Decided or forced to send as is
+	started       bool // Decision made, headers written
+	buffer        []byte
+	compressor    io.WriteCloser
+}
+
+func (w *compressWriter) ensureStatus() {
+	if w.statusCode == 0 {
+		w.WriteStatus(200)
+	}
+}
+
+func (w *compressWriter) WriteStatus(statusCode int) {
+	if w.statusCode != 0 {
+		return
+	}
+	w.statusCode = statusCode
+	if statusCode == 206 || statusWithoutBody(statusCode) {
+		w.skip = true
+	}
+	w.ResponseWriter.WriteStatus(statusCode)
+}
+
+func (w *compressWriter) WriteDate(date string) {
+	w.ensureStatus()
+	w.ResponseWriter.WriteDate(date)
+}
+
+func (w *compressWriter) WriteServer(server string) {
+	w.ensureStatus()
+	w.ResponseWriter.WriteServer(server)
+}
+
+func (w *compressWriter) WriteContentLength(length int64) {
+	w.ensureStatus()
+	if w.started {
+		w.ResponseWriter.WriteContentLength(length) // Lets wrapped writer reject it
+		return
+	}
+	w.contentLength = length
+}
+
+func (w *compressWriter) WriteOtherHeader(key string, value string) {
+	w.ensureStatus()
+	switch strings.ToLower(key) {
+	case "content-type":
+		w.compressible = isCompressibleType(value)
+	case "content-encoding", "content-range":
+		w.skip = true
+	case "etag":
+		if !w.started {
+			w.etag = value
+			return
+		}
+	}
+	w.ResponseWriter.WriteOtherHeader(key, value)
+}
+
+func (w *compressWriter) WriteSetCookie(cookie *Cookie) error {
+	w.ensureStatus()
+	return w.ResponseWriter.WriteSetCookie(cookie)
+}
+
+// start writes held headers, compressed tells if body goes through compressor
+func (w *compressWriter) start(compressed bool) {
+	w.started = true
+	if w.compressible && !w.skip {
+		w.ResponseWriter.WriteOtherHeader("vary", "Accept-Encoding") // Answer depends on it even if not compressed now
+	}
+	if !compressed {
+		w.skip = true
+		if w.etag != "" {
+			w.ResponseWriter.WriteOtherHeader("etag", w.etag)
+		}
+		if w.contentLength >= 0 {
+			w.ResponseWriter.WriteContentLength(w.contentLength)
+		}
+		return
+	}
+	if w.etag != "" { // Compressed bytes differ, so validator cannot be strong anymore
+		if !strings.HasPrefix(w.etag, "W/") {
+			w.etag = "W/" + w.etag
+		}
+		w.ResponseWriter.WriteOtherHeader("etag", w.etag)
+	}
+	w.ResponseWriter.WriteOtherHeader("content-encoding", encodingNames[w.encoding])
+	switch w.encoding {
+	case ENCODING_GZIP:
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(w.ResponseWriter)
+		w.compressor = gw
+	case ENCODING_DEFLATE:
+		zw := zlibWriters.Get().(*zlib.Writer)
+		zw.Reset(w.ResponseWriter)
+		w.compressor = zw
+	}
+}
+
+// canCompress tells if response is eligible, ignoring size
+func (w *compressWriter) canCompress() bool {
+	return w.encoding != ENCODING_IDENTITY && w.compressible && !w.skip
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	w.ensureStatus()
+	if !w.started {
+		if !w.canCompress() || (w.contentLength >= 0 && w.contentLength < int64(w.minSize)) {
+			w.start(false)
+		} else if w.contentLength < 0 && len(w.buffer)+len(data) < w.minSize {
+			w.buffer = append(w.buffer, data...) // Body may still turn out small
+			return len(data), nil
+		} else {
+			w.start(true)
+		}
+		if err := w.writeBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) writeBuffer() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	var err error
+	if w.compressor != nil {
+		_, err = w.compressor.Write(w.buffer)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buffer)
+	}
+	w.buffer = w.buffer[:0]
+	return err
+}
+
+// Flush compresses buffered body, because streaming response cannot wait for minSize
+func (w *compressWriter) Flush() error {
+	w.ensureStatus()
+	if !w.started {
+		w.start(w.canCompress() && w.contentLength != 0)
+		if err := w.writeBuffer(); err != nil {
+			return err
+		}
+	}
+	if fl, ok := w.compressor.(interface{ Flush() error }); ok {
+		if err := fl.Flush(); err != nil {
+			return err
+		}
+	}
+	return w.ResponseWriter.Flush()
+}
+
+// finish writes small body as is or completes compressed stream, called after handler returns
+func (w *compressWriter) finish() error {
+	if w.statusCode == 0 {
+		return nil // Handler wrote nothing, wrapped writer sends default response
+	}
+	if !w.started {
+		if w.contentLength < 0 && len(w.buffer) != 0 {
+			w.contentLength = int64(len(w.buffer)) // Small body, so no chunked encoding
+		}
+		w.start(false)
+		if err := w.writeBuffer(); err != nil {
+			return err
+		}
+	}
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	return nil
+}
+
+func (w *compressWriter) release() {
+	switch c := w.compressor.(type) {
+	case *gzip.Writer:
+		c.Reset(nil)
+		gzipWriters.Put(c)
+	case *zlib.Writer:
+		c.Reset(nil)
+		zlibWriters.Put(c)
+	}
+	w.compressor = nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   int
+	}{
+		{"", ENCODING_IDENTITY},
+		{"gzip", ENCODING_GZIP},
+		{"x-gzip", ENCODING_GZIP},
+		{"deflate, gzip;q=0.5", ENCODING_DEFLATE},
+		{"gzip;q=0, deflate;q=0.001", ENCODING_DEFLATE},
+		{"*;q=0.1, gzip;q=0", ENCODING_DEFLATE},
+		{"*", ENCODING_GZIP},
+		{"deflate, gzip", ENCODING_GZIP}, // Tie
+		{"GZIP ; Q=0.9, deflate;q=1.0", ENCODING_DEFLATE},
+		{"br, zstd, identity", ENCODING_IDENTITY}, // Not supported
+		{"gzip;q=2", ENCODING_IDENTITY},
+	} {
+		r := &Request{}
+		if tc.header != "" {
+			r.Headers = []HeaderKV{{key: []byte("accept-encoding"), value: []byte(tc.header)}}
+		}
+		if got := acceptedEncoding(r); got != tc.want {
+			t.Errorf("%q: got %d, want %d", tc.header, got, tc.want)
+		}
+	}
+}
+
+var compressBody = strings.Repeat("hello compress ", 1000)
+
+func compressHandler(wr ResponseWriter, r *Request) {
+	switch string(r.Path) {
+	case "/big":
+		wr.WriteOtherHeader("content-type", "text/plain")
+		wr.WriteOtherHeader("etag", `"x"`)
+		wr.WriteContentLength(int64(len(compressBody)))
+		_, _ = io.WriteString(wr, compressBody)
+	case "/small":
+		wr.WriteOtherHeader("content-type", "text/plain")
+		_, _ = io.WriteString(wr, "tiny")
+	case "/png":
+		wr.WriteOtherHeader("content-type", "image/png")
+		_, _ = io.WriteString(wr, compressBody)
+	case "/encoded":
+		wr.WriteOtherHeader("content-type", "text/plain")
+		wr.WriteOtherHeader("content-encoding", "gzip")
+		_, _ = io.WriteString(wr, compressBody)
+	case "/stream":
+		wr.WriteOtherHeader("content-type", "text/plain")
+		_, _ = io.WriteString(wr, "a")
+		wr.Flush()
+		_, _ = io.WriteString(wr, compressBody)
+	}
+}
+
+func compressGet(t *testing.T, conn net.Conn, path string, acceptEncoding string) (*http.Response, string) {
+	t.Helper()
+	return roundTrip(t, conn, "GET "+path+" HTTP/1.1\r\nHost: x\r\nAccept-Encoding: "+acceptEncoding+"\r\n\r\n")
+}
+
+func TestCompressGzipAndDeflate(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: Chain(compressHandler, Compress(0))}))
+	for _, tc := range []struct {
+		encoding  string
+		newReader func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"deflate", func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }},
+	} {
+		resp, body := compressGet(t, conn, "/big", tc.encoding)
+		if resp.Header.Get("Content-Encoding") != tc.encoding || resp.Header.Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("%s: %v", tc.encoding, resp.Header)
+		}
+		if resp.Header.Get("Etag") != `W/"x"` || len(resp.TransferEncoding) == 0 || resp.ContentLength != -1 {
+			t.Fatalf("%s: etag %q, transfer-encoding %v, length %d", tc.encoding, resp.Header.Get("Etag"), resp.TransferEncoding, resp.ContentLength)
+		}
+		zr, err := tc.newReader(strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(zr); err != nil || string(b) != compressBody || len(body) > 500 {
+			t.Fatalf("%s: %d bytes decoded from %d, %v", tc.encoding, len(b), len(body), err)
+		}
+	}
+}
+
+func TestCompressSkipped(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: Chain(compressHandler, Compress(0))}))
+	resp, body := compressGet(t, conn, "/big", "identity")
+	if resp.Header.Get("Content-Encoding") != "" || body != compressBody || resp.ContentLength != int64(len(compressBody)) {
+		t.Fatalf("identity: %v, %d", resp.Header, resp.ContentLength)
+	}
+	if resp.Header.Get("Vary") != "Accept-Encoding" || resp.Header.Get("Etag") != `"x"` {
+		t.Fatalf("identity: %v", resp.Header)
+	}
+	resp, body = compressGet(t, conn, "/small", "gzip")
+	if resp.Header.Get("Content-Encoding") != "" || body != "tiny" || resp.ContentLength != 4 {
+		t.Fatalf("small: %v, %q", resp.Header, body)
+	}
+	resp, body = compressGet(t, conn, "/png", "gzip")
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Vary") != "" || body != compressBody {
+		t.Fatalf("png: %v", resp.Header)
+	}
+	resp, body = compressGet(t, conn, "/encoded", "gzip")
+	if resp.Header.Values("Content-Encoding")[0] != "gzip" || len(resp.Header.Values("Content-Encoding")) != 1 || body != compressBody {
+		t.Fatalf("encoded: %v", resp.Header)
+	}
+	_, _ = io.WriteString(conn, "HEAD /big HTTP/1.1\r\nHost: x\r\nAccept-Encoding: gzip\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != int64(len(compressBody)) {
+		t.Fatalf("HEAD: %v, %d", resp.Header, resp.ContentLength)
+	}
+}
+
+func TestCompressStream(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: Chain(compressHandler, Compress(0))}))
+	resp, body := compressGet(t, conn, "/stream", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal(resp.Header)
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(zr); err != nil || string(b) != "a"+compressBody {
+		t.Fatalf("%d bytes, %v", len(b), err)
+	}
+}
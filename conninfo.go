@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// ConnInfo describes connection on which request arrived
+type ConnInfo struct {
+	RemoteAddr net.Addr // From PROXY protocol header if enabled
+	LocalAddr  net.Addr
+	RequestNum int // 1 for the first request on connection
+	StartTime  time.Time
+}
+
+func (r *Request) ConnInfo() ConnInfo {
+	c := r.client
+	if c == nil {
+		return ConnInfo{RemoteAddr: r.RemoteAddr}
+	}
+	return ConnInfo{
+		RemoteAddr: r.RemoteAddr,
+		LocalAddr:  c.conn.LocalAddr(),
+		RequestNum: r.requestNum,
+		StartTime:  c.startTime,
+	}
+}
+
+func addrIP(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip.Unmap()
+	case *net.UDPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip.Unmap()
+	}
+	return netip.Addr{}
+}
+
+func ipTrusted(nets []*net.IPNet, ip netip.Addr) bool {
+	a16 := ip.As16()
+	for _, n := range nets {
+		if n.Contains(a16[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns client address, resolving Forwarded, X-Forwarded-For and X-Real-IP
+// (in that order of preference) set by proxies from Server.TrustedProxies.
+// Hops are walked from the right, the first address not in TrustedProxies is the client.
+// Returns invalid Addr if RemoteAddr is not an IP address.
+func (r *Request) ClientIP() netip.Addr {
+	ip := addrIP(r.RemoteAddr)
+	if r.client == nil || !ip.IsValid() || !ipTrusted(r.client.server.TrustedProxies, ip) {
+		return ip
+	}
+	nets := r.client.server.TrustedProxies
+	if resolved, found := r.resolveHops("forwarded", parseForwardedFor, nets, ip); found {
+		return resolved
+	}
+	if resolved, found := r.resolveHops("x-forwarded-for", parseForwardedIP, nets, ip); found {
+		return resolved
+	}
+	if resolved, ok := parseForwardedIP(r.HeaderLower("x-real-ip")); ok {
+		return resolved
+	}
+	return ip
+}
+
+// resolveHops walks comma-separated hops of all headers with lowerKey from the right.
+// If hop cannot be parsed, we stop and return the last trusted address, because
+// everything to the left of it could be set by the client.
+func (r *Request) resolveHops(lowerKey string, parse func([]byte) (netip.Addr, bool), nets []*net.IPNet, ip netip.Addr) (netip.Addr, bool) {
+	found := false
+	for i := len(r.Headers) - 1; i >= 0; i-- {
+		if string(r.Headers[i].key) != lowerKey {
+			continue
+		}
+		value := r.Headers[i].value
+		for end := len(value); end >= 0; {
+			start := end - 1
+			for start >= 0 && value[start] != ',' {
+				start--
+			}
+			hop := trimSP(value[start+1 : end])
+			end = start
+			if len(hop) == 0 {
+				continue
+			}
+			found = true
+			hopIP, ok := parse(hop)
+			if !ok {
+				return ip, true
+			}
+			ip = hopIP
+			if !ipTrusted(nets, ip) {
+				return ip, true
+			}
+		}
+	}
+	return ip, found
+}
+
+func trimSP(value []byte) []byte {
+	for len(value) != 0 && isSP(value[0]) {
+		value = value[1:]
+	}
+	for len(value) != 0 && isSP(value[len(value)-1]) {
+		value = value[:len(value)-1]
+	}
+	return value
+}
+
+// "192.0.2.60", "192.0.2.60:4711", "[2001:db8::17]:4711" or "2001:db8::17"
+func parseForwardedIP(value []byte) (netip.Addr, bool) {
+	value = trimSP(value)
+	if len(value) != 0 && value[0] == '[' {
+		end := 1
+		for end < len(value) && value[end] != ']' {
+			end++
+		}
+		value = value[1:end]
+	} else if colon := bytes.LastIndexByte(value, ':'); colon >= 0 && bytes.IndexByte(value, ':') == colon {
+		value = value[:colon] // IPv4 with port
+	}
+	ip, err := netip.ParseAddr(string(value))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// `for=192.0.2.60;proto=http;by=203.0.113.43` or `for="[2001:db8:cafe::17]:4711"`
+func parseForwardedFor(hop []byte) (netip.Addr, bool) {
+	for len(hop) != 0 {
+		end := bytes.IndexByte(hop, ';')
+		if end < 0 {
+			end = len(hop)
+		}
+		pair := trimSP(hop[:end])
+		if end < len(hop) {
+			end++
+		}
+		hop = hop[end:]
+		if len(pair) < 4 || toLower(pair[0]) != 'f' || toLower(pair[1]) != 'o' || toLower(pair[2]) != 'r' || pair[3] != '=' {
+			continue
+		}
+		value := pair[4:]
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		return parseForwardedIP(value) // "unknown" and obfuscated "_hidden" are not parsed
+	}
+	return netip.Addr{}, false
+}
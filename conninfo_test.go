@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func connInfoServer(t *testing.T, trusted ...string) string {
+	s := &Server{handler: func(wr ResponseWriter, r *Request) {
+		info := r.ConnInfo()
+		result := fmt.Sprintf("%s %d %v", r.ClientIP(), info.RequestNum, info.LocalAddr != nil && !info.StartTime.IsZero())
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}, H2C: true}
+	for _, cidr := range trusted {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.TrustedProxies = append(s.TrustedProxies, n)
+	}
+	return startServer(t, s)
+}
+
+func TestClientIPFromTrustedProxies(t *testing.T) {
+	conn := dial(t, connInfoServer(t, "127.0.0.0/8", "10.0.0.0/8"))
+	for i, tc := range []struct{ headers, want string }{
+		{"", "127.0.0.1"},
+		{"X-Forwarded-For: 1.1.1.1, 2.2.2.2, 10.0.0.1\r\n", "2.2.2.2"},
+		{"X-Forwarded-For: 1.1.1.1\r\nX-Forwarded-For: 2.2.2.2, 10.0.0.1\r\n", "2.2.2.2"},
+		{"Forwarded: for=1.1.1.1, for=\"[2001:db8::1]:55\";proto=http\r\nX-Forwarded-For: 3.3.3.3\r\n", "2001:db8::1"},
+		{"X-Real-IP: 4.4.4.4\r\n", "4.4.4.4"},
+		{"X-Forwarded-For: 5.5.5.5:80, garbage, 10.1.1.1\r\n", "10.1.1.1"}, // Stop at what we cannot parse
+		{"X-Forwarded-For: 10.2.2.2\r\n", "10.2.2.2"},
+	} {
+		want := fmt.Sprintf("%s %d true", tc.want, i+1)
+		if _, got := roundTrip(t, conn, "GET / HTTP/1.1\r\n"+tc.headers+"\r\n"); got != want {
+			t.Errorf("%q: got %q, want %q", tc.headers, got, want)
+		}
+	}
+}
+
+func TestClientIPUntrustedRemote(t *testing.T) {
+	conn := dial(t, connInfoServer(t, "10.0.0.0/8"))
+	if _, got := roundTrip(t, conn, "GET / HTTP/1.1\r\nX-Forwarded-For: 1.1.1.1\r\nX-Real-IP: 4.4.4.4\r\n\r\n"); got != "127.0.0.1 1 true" {
+		t.Fatal(got)
+	}
+}
+
+// HTTP/2 streams see the same connection info as HTTP/1.1 requests, numbered in order of arrival
+func TestConnInfoHTTP2(t *testing.T) {
+	conn, br, _ := dialH2(t, connInfoServer(t, "127.0.0.0/8"))
+	for i, streamID := range []uint32{1, 3} {
+		block := hpackAppendField(append([]byte{}, h2GetBlock...), "x-forwarded-for", "1.1.1.1")
+		writeH2Frame(t, conn, H2_FRAME_HEADERS, H2_FLAG_END_HEADERS|H2_FLAG_END_STREAM, streamID, block)
+		f := nextH2Frame(t, br)
+		for f.typ != H2_FRAME_DATA || len(f.payload) == 0 { // Skip HEADERS and empty END_STREAM
+			f = nextH2Frame(t, br)
+		}
+		if want := fmt.Sprintf("1.1.1.1 %d true", i+1); f.streamID != streamID || string(f.payload) != want {
+			t.Fatalf("stream %d: got %q, want %q", f.streamID, f.payload, want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Context is cancelled when handler returns, the peer closes connection, the server is closed
+// or Server.RequestTimeout since request start elapses. Created on the first call, so handlers
+// not using it pay nothing. Connection is watched only after request body is read to the end.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	if r.client == nil {
+		return context.Background()
+	}
+	c := r.client
+	s := c.server
+	if s.RequestTimeout > 0 {
+		r.ctx, c.cancel = context.WithDeadline(s.baseContext(), c.requestStart.Add(s.RequestTimeout))
+	} else {
+		r.ctx, c.cancel = context.WithCancel(s.baseContext())
+	}
+	if c.body.err != nil {
+		c.startBackgroundRead()
+	}
+	return r.ctx
+}
+
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.ctxCancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+// startBackgroundRead waits for peer to close connection while handler runs. Starts only after
+// body is read, and reads into backgroundReadBuffer, because handler still uses incomingBuffer.
+func (c *Client) startBackgroundRead() {
+	if c.cancel == nil || c.backgroundReadDone != nil || c.hijacked || c.body.err == nil {
+		return
+	}
+	if c.incomingReadPos != c.incomingWritePos {
+		return // Pipelined data is already waiting, so client did not go away
+	}
+	done := make(chan struct{})
+	c.backgroundReadDone = done
+	cancel := c.cancel
+	go func() {
+		n, err := c.incomingReader.Read(c.backgroundReadBuffer[:])
+		c.backgroundReadN = n
+		c.backgroundReadErr = err
+		if n == 0 && err != nil && !isTimeout(err) {
+			cancel() // Peer closed connection or connection failed
+		}
+		close(done)
+	}()
+}
+
+// stopBackgroundRead moves bytes of the next pipelined request read in background to incomingBuffer.
+// Returns false if connection failed during background read.
+func (c *Client) stopBackgroundRead() bool {
+	if c.backgroundReadDone == nil {
+		return true
+	}
+	_ = c.conn.SetReadDeadline(aLongTimeAgo)
+	<-c.backgroundReadDone
+	c.backgroundReadDone = nil
+	_ = c.conn.SetReadDeadline(time.Time{})
+	if c.incomingReadPos == c.incomingWritePos { // Body is read, header before bodyStart may be still in use
+		c.incomingReadPos = c.bodyStart
+		c.incomingWritePos = c.bodyStart
+	}
+	c.incomingWritePos += copy(c.incomingBuffer[c.incomingWritePos:], c.backgroundReadBuffer[:c.backgroundReadN])
+	return c.backgroundReadErr == nil || isTimeout(c.backgroundReadErr)
+}
+
+// finishContext is called after handler returns
+func (c *Client) finishContext() bool {
+	ok := c.stopBackgroundRead()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	c.request.ctx = nil
+	return ok
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
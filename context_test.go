@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func contextHandler(results chan<- string) Handler {
+	return func(wr ResponseWriter, r *Request) {
+		switch string(r.Path) {
+		case "/wait":
+			select {
+			case <-r.Context().Done():
+				results <- "cancelled " + r.Context().Err().Error()
+			case <-time.After(2 * time.Second):
+				results <- "not cancelled"
+			}
+		case "/body":
+			ctx := r.Context()
+			b, _ := io.ReadAll(r.Body())
+			time.Sleep(50 * time.Millisecond) // Next request arrives while handler runs
+			status := "live"
+			if ctx.Err() != nil {
+				status = ctx.Err().Error()
+			}
+			results <- string(r.Path) + " " + string(r.HeaderLower("x-n")) + " " + string(b) + " " + status
+		}
+		wr.WriteContentLength(2)
+		_, _ = wr.Write([]byte("ok"))
+	}
+}
+
+func TestContextCancelledOnPeerClose(t *testing.T) {
+	results := make(chan string, 1)
+	conn := dial(t, startServer(t, &Server{handler: contextHandler(results)}))
+	_, _ = io.WriteString(conn, "GET /wait HTTP/1.1\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	_ = conn.Close()
+	if got := <-results; got != "cancelled context canceled" {
+		t.Fatal(got)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	results := make(chan string, 1)
+	conn := dial(t, startServer(t, &Server{handler: contextHandler(results), RequestTimeout: 100 * time.Millisecond}))
+	_, _ = io.WriteString(conn, "GET /wait HTTP/1.1\r\n\r\n")
+	if got := <-results; got != "cancelled context deadline exceeded" {
+		t.Fatal(got)
+	}
+}
+
+func TestContextCancelledOnServerClose(t *testing.T) {
+	results := make(chan string, 1)
+	s := &Server{handler: contextHandler(results)}
+	conn := dial(t, startServer(t, s))
+	_, _ = io.WriteString(conn, "GET /wait HTTP/1.1\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+	_ = s.Close()
+	if got := <-results; got != "cancelled context canceled" {
+		t.Fatal(got)
+	}
+}
+
+// Background read must neither lose pipelined bytes nor touch header of running request
+func TestContextBackgroundReadKeepsPipelinedRequest(t *testing.T) {
+	results := make(chan string, 2)
+	conn := dial(t, startServer(t, &Server{handler: contextHandler(results)}))
+	_, _ = io.WriteString(conn, "POST /body HTTP/1.1\r\nX-N: 1\r\nContent-Length: 3\r\n\r\nabc")
+	time.Sleep(10 * time.Millisecond)
+	padding := strings.Repeat("p", 200) // Longer than background read buffer
+	_, _ = io.WriteString(conn, "POST /body HTTP/1.1\r\nX-N: 2\r\nX-Padding: "+padding+"\r\nContent-Length: 3\r\n\r\nxyz")
+	if got := <-results; got != "/body 1 abc live" {
+		t.Fatal(got)
+	}
+	if got := <-results; got != "/body 2 xyz live" {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// SameSite is value of SameSite attribute of Set-Cookie
+type SameSite int
+
+const (
+	SAME_SITE_DEFAULT SameSite = iota // Attribute not written, browser decides
+	SAME_SITE_LAX
+	SAME_SITE_STRICT
+	SAME_SITE_NONE // Requires Secure
+)
+
+var sameSiteNames = [...]string{SAME_SITE_LAX: "Lax", SAME_SITE_STRICT: "Strict", SAME_SITE_NONE: "None"}
+
+// Cookie is written by ResponseWriter.WriteSetCookie, zero attributes are not written
+type Cookie struct {
+	Name        string
+	Value       string
+	Path        string
+	Domain      string
+	Expires     time.Time // Zero means session cookie
+	MaxAge      int       // Seconds, 0 means not written, negative deletes cookie (Max-Age=0)
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool // Requires Secure
+}
+
+var ErrCookieName = errors.New("Invalid cookie name")
+var ErrCookieValue = errors.New("Invalid cookie value")
+var ErrCookieAttribute = errors.New("Invalid cookie attribute")
+
+var errHeadersWritten = errors.New("Headers already written")
+
+// Cookies returns pairs of all cookie headers, parsed in place on the first call.
+// Values are not decoded, only surrounding quotes are removed. Pairs without name or '=' are skipped.
+func (r *Request) Cookies() *Args {
+	if !r.cookiesParsed {
+		r.cookies.kvs = r.cookies.kvs[:0]
+		for i := range r.Headers {
+			if r.Headers[i].id == HEADER_COOKIE { // HTTP/2 clients may split cookies into several headers
+				r.cookies.parseCookies(r.Headers[i].value)
+			}
+		}
+		r.cookiesParsed = true
+	}
+	return &r.cookies
+}
+
+// Cookie returns value of the first cookie with name, nil if not found. Names are case-sensitive.
+func (r *Request) Cookie(name string) []byte {
+	return r.Cookies().Peek(name)
+}
+
+// parseCookies appends "name=value; name2=value2" pairs to a
+func (a *Args) parseCookies(b []byte) {
+	for len(b) != 0 {
+		var pair []byte
+		if semi := bytes.IndexByte(b, ';'); semi >= 0 {
+			pair, b = b[:semi], b[semi+1:]
+		} else {
+			pair, b = b, nil
+		}
+		eq := bytes.IndexByte(pair, '=')
+		if eq < 0 {
+			continue
+		}
+		name, value := trimSP(pair[:eq]), trimSP(pair[eq+1:])
+		if len(name) == 0 {
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		a.kvs = append(a.kvs, argKV{key: name, value: value})
+	}
+}
+
+// isCookieOctet tells if c can be in cookie value, RFC 6265 excludes CTLs, whitespace, DQUOTE, comma, semicolon and backslash
+func isCookieOctet(c byte) bool {
+	return c > ' ' && c < 127 && c != '"' && c != ',' && c != ';' && c != '\\'
+}
+
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !isChar(c) || isCTL(c) || isTSpecial(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func validCookieValue(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		if !isCookieOctet(value[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// validCookiePath allows any CHAR except CTLs and ';'
+func validCookiePath(path string) bool {
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; !isChar(c) || isCTL(c) || c == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+func validCookieDomain(domain string) bool {
+	for i := 0; i < len(domain); i++ {
+		c := domain[i] | 0x20
+		if !(c >= 'a' && c <= 'z') && !isDigit(domain[i]) && domain[i] != '-' && domain[i] != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func (cookie *Cookie) validate() error {
+	if !validCookieName(cookie.Name) {
+		return ErrCookieName
+	}
+	if !validCookieValue(cookie.Value) {
+		return ErrCookieValue
+	}
+	if !validCookiePath(cookie.Path) || !validCookieDomain(cookie.Domain) {
+		return ErrCookieAttribute
+	}
+	if year := cookie.Expires.Year(); !cookie.Expires.IsZero() && (year < 1601 || year > 9999) {
+		return ErrCookieAttribute
+	}
+	if cookie.SameSite < SAME_SITE_DEFAULT || cookie.SameSite > SAME_SITE_NONE {
+		return ErrCookieAttribute
+	}
+	if (cookie.SameSite == SAME_SITE_NONE || cookie.Partitioned) && !cookie.Secure {
+		return ErrCookieAttribute // Browsers reject such cookies
+	}
+	return nil
+}
+
+// appendCookie appends Set-Cookie value to b, cookie must be validated
+func appendCookie(b []byte, cookie *Cookie) []byte {
+	b = append(b, cookie.Name...)
+	b = append(b, '=')
+	b = append(b, cookie.Value...)
+	if cookie.Path != "" {
+		b = append(b, "; Path="...)
+		b = append(b, cookie.Path...)
+	}
+	if cookie.Domain != "" {
+		b = append(b, "; Domain="...)
+		b = append(b, cookie.Domain...)
+	}
+	if !cookie.Expires.IsZero() {
+		b = append(b, "; Expires="...)
+		b = appendTime(b, cookie.Expires)
+	}
+	if cookie.MaxAge > 0 {
+		b = append(b, "; Max-Age="...)
+		b = strconv.AppendInt(b, int64(cookie.MaxAge), 10)
+	} else if cookie.MaxAge < 0 {
+		b = append(b, "; Max-Age=0"...)
+	}
+	if cookie.HttpOnly {
+		b = append(b, "; HttpOnly"...)
+	}
+	if cookie.Secure {
+		b = append(b, "; Secure"...)
+	}
+	if cookie.SameSite != SAME_SITE_DEFAULT {
+		b = append(b, "; SameSite="...)
+		b = append(b, sameSiteNames[cookie.SameSite]...)
+	}
+	if cookie.Partitioned {
+		b = append(b, "; Partitioned"...)
+	}
+	return b
+}
+
+// WriteSetCookie formats cookie directly into outgoingBuffer, errOVerflow if it does not fit
+func (c *Client) WriteSetCookie(cookie *Cookie) error {
+	if err := cookie.validate(); err != nil {
+		return err
+	}
+	if c.writerState == CONNECTION_EXPECT_STATUS {
+		c.WriteStatus(200)
+	}
+	if c.writerState != CONNECTION_EXPECT_HEADERS {
+		return errHeadersWritten
+	}
+	start := c.outgoingWritePos
+	if err := c.writeSetCookieLine(cookie); err != nil {
+		c.outgoingWritePos = start // No partial header line
+		return err
+	}
+	return nil
+}
+
+func (c *Client) writeSetCookieLine(cookie *Cookie) error {
+	if err := c.writeString("set-cookie: "); err != nil {
+		return err
+	}
+	free := c.outgoingBuffer[c.outgoingWritePos:c.outgoingWritePos:len(c.outgoingBuffer)]
+	value := appendCookie(free, cookie)
+	if len(value) > cap(free) { // append moved it elsewhere
+		return errOVerflow
+	}
+	c.outgoingWritePos += len(value)
+	return c.writeString("\r\n")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestCookies(t *testing.T) {
+	r := parsedRequest(t, "GET / HTTP/1.1\r\nCookie: a=1; b = \"two\" ;;noeq; =x; c=\r\nX: y\r\ncookie: d=4\r\n\r\n")
+	var got []string
+	r.Cookies().VisitAll(func(key []byte, value []byte) { got = append(got, string(key)+"="+string(value)) })
+	if fmt.Sprint(got) != "[a=1 b=two c= d=4]" {
+		t.Fatal(got)
+	}
+	if string(r.Cookie("d")) != "4" || r.Cookie("A") != nil {
+		t.Fatal(r.Cookie("d"))
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		r.cookiesParsed = false
+		_ = r.Cookie("b")
+	})
+	if allocs != 0 {
+		t.Fatal(allocs)
+	}
+}
+
+func TestCookieValidate(t *testing.T) {
+	for _, tc := range []struct {
+		cookie Cookie
+		want   error
+	}{
+		{Cookie{Name: "a", Value: "1"}, nil},
+		{Cookie{Name: "a", Value: `"quoted"`}, nil},
+		{Cookie{Name: "a", Value: ""}, nil},
+		{Cookie{Name: "", Value: "1"}, ErrCookieName},
+		{Cookie{Name: "bad name", Value: "1"}, ErrCookieName},
+		{Cookie{Name: "a=b", Value: "1"}, ErrCookieName},
+		{Cookie{Name: "a;", Value: "1"}, ErrCookieName},
+		{Cookie{Name: "a", Value: "a b"}, ErrCookieValue},
+		{Cookie{Name: "a", Value: "a;b"}, ErrCookieValue},
+		{Cookie{Name: "a", Value: "a,b"}, ErrCookieValue},
+		{Cookie{Name: "a", Value: `a"b`}, ErrCookieValue},
+		{Cookie{Name: "a", Value: "\x7f"}, ErrCookieValue},
+		{Cookie{Name: "a", Path: "/x;Secure"}, ErrCookieAttribute},
+		{Cookie{Name: "a", Domain: "ex_ample.com"}, ErrCookieAttribute},
+		{Cookie{Name: "a", Expires: time.Date(1500, 1, 1, 0, 0, 0, 0, time.UTC)}, ErrCookieAttribute},
+		{Cookie{Name: "a", SameSite: SAME_SITE_NONE + 1}, ErrCookieAttribute},
+		{Cookie{Name: "a", SameSite: SAME_SITE_NONE}, ErrCookieAttribute},
+		{Cookie{Name: "a", Partitioned: true}, ErrCookieAttribute},
+		{Cookie{Name: "a", SameSite: SAME_SITE_NONE, Partitioned: true, Secure: true}, nil},
+	} {
+		if err := tc.cookie.validate(); err != tc.want {
+			t.Errorf("%+v: got %v, want %v", tc.cookie, err, tc.want)
+		}
+	}
+}
+
+const setCookieWant = "[id=abc; Path=/; Domain=example.com; Max-Age=60; HttpOnly; Secure; SameSite=Lax " +
+	"old=; Expires=Thu, 02 Jan 2020 03:04:05 GMT; Max-Age=0 p=1; Secure; SameSite=None; Partitioned]"
+
+func TestWriteSetCookie(t *testing.T) {
+	errs := make(chan string, 1)
+	h := func(wr ResponseWriter, r *Request) {
+		results := []error{
+			wr.WriteSetCookie(&Cookie{Name: "id", Value: "abc", Path: "/", Domain: "example.com", MaxAge: 60, HttpOnly: true, Secure: true, SameSite: SAME_SITE_LAX}),
+			wr.WriteSetCookie(&Cookie{Name: "old", Expires: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), MaxAge: -1}),
+			wr.WriteSetCookie(&Cookie{Name: "bad name", Value: "x"}),
+			wr.WriteSetCookie(&Cookie{Name: "p", Value: "1", Partitioned: true, Secure: true, SameSite: SAME_SITE_NONE}),
+		}
+		wr.WriteContentLength(2)
+		_, _ = wr.Write([]byte("ok"))
+		results = append(results, wr.WriteSetCookie(&Cookie{Name: "late", Value: "x"}))
+		errs <- fmt.Sprint(results)
+	}
+	for _, handler := range []Handler{h, Chain(h, Compress(0))} {
+		conn := dial(t, startServer(t, &Server{handler: handler}))
+		resp, _ := roundTrip(t, conn, "GET / HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n")
+		if got := fmt.Sprint(resp.Header["Set-Cookie"]); got != setCookieWant {
+			t.Errorf("got %s, want %s", got, setCookieWant)
+		}
+		if got := <-errs; got != "[<nil> <nil> Invalid cookie name <nil> Headers already written]" {
+			t.Error(got)
+		}
+	}
+}
+
+// Cookie which does not fit into outgoingBuffer leaves no partial header line, whichever write fails
+func TestWriteSetCookieOverflow(t *testing.T) {
+	cookie := &Cookie{Name: "id", Value: "abc", HttpOnly: true}
+	const prefix = "HTTP/1.1 200 OK\r\n"
+	line := "set-cookie: id=abc; HttpOnly\r\n"
+	for size := len(prefix); size <= len(prefix)+len(line); size++ {
+		c := &Client{outgoingBuffer: make([]byte, size), writerState: CONNECTION_EXPECT_HEADERS}
+		c.outgoingWritePos = copy(c.outgoingBuffer, prefix)
+		err := c.WriteSetCookie(cookie)
+		want, wantErr := prefix+line, error(nil)
+		if size < len(want) {
+			want, wantErr = prefix, errOVerflow
+		}
+		if got := string(c.outgoingBuffer[:c.outgoingWritePos]); got != want || err != wantErr {
+			t.Fatalf("buffer of %d: %q, %v", size, got, err)
+		}
+	}
+}
+
+func cookieEcho(wr ResponseWriter, r *Request) {
+	var cookies []string
+	r.Cookies().VisitAll(func(key []byte, value []byte) { cookies = append(cookies, string(key)+"="+string(value)) })
+	err := wr.WriteSetCookie(&Cookie{Name: "got", Value: strings.Join(cookies, "-"), HttpOnly: true})
+	bad := wr.WriteSetCookie(&Cookie{Name: "x", Value: "a b"})
+	_, _ = io.WriteString(wr, fmt.Sprint(err, " ", bad))
+}
+
+// HTTP/2 clients may split cookie header into one field per cookie, RFC 9113 section 8.2.3
+func TestCookiesHTTP2Split(t *testing.T) {
+	conn, br, _ := dialH2(t, startServer(t, &Server{handler: cookieEcho, H2C: true}))
+	block := hpackAppendField(append([]byte{}, h2GetBlock...), "cookie", "a=1")
+	block = hpackAppendField(block, "cookie", "b=2; c=3")
+	writeH2Frame(t, conn, H2_FRAME_HEADERS, H2_FLAG_END_HEADERS|H2_FLAG_END_STREAM, 1, block)
+	headers := nextH2Frame(t, br)
+	var d hpackDecoder
+	fields, err := hpackDecodeAll(t, &d, headers.payload)
+	if headers.typ != H2_FRAME_HEADERS || err != nil || !strings.Contains(fields, "set-cookie: got=a=1-b=2-c=3; HttpOnly") {
+		t.Fatalf("%q, %v", fields, err)
+	}
+	if data := nextH2Frame(t, br); data.typ != H2_FRAME_DATA || string(data.payload) != "<nil> Invalid cookie value" {
+		t.Fatalf("%d %q", data.typ, data.payload)
+	}
+}
+
+func TestCookiesNetHTTP(t *testing.T) {
+	srv := httptest.NewServer(ToHTTPHandler(cookieEcho))
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Add("Cookie", "a=1")
+	req.Header.Add("Cookie", "b=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Set-Cookie") != "got=a=1-b=2; HttpOnly" || string(b) != "<nil> Invalid cookie value" {
+		t.Fatal(resp.Header, string(b))
+	}
+}
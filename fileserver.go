@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileServer serves files from FS, use Serve as Handler. Directories are served by their
+// index file, there are no listings.
+type FileServer struct {
+	FS        fs.FS
+	Prefix    string // Stripped from Request.Path, not needed when PathParam is used
+	PathParam string // Take path from router catch-all parameter, like "filepath" of "/static/*filepath"
+	IndexFile string // "index.html" if empty
+}
+
+func NewFileServer(root string) *FileServer {
+	return &FileServer{FS: os.DirFS(root)}
+}
+
+const maxRanges = 16 // More ranges are served as the whole file, so they cannot amplify traffic
+
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// Serve answers GET and HEAD with file contents, honouring Range and conditional headers
+func (fsrv *FileServer) Serve(wr ResponseWriter, r *Request) {
+	if string(r.Method) != "GET" && string(r.Method) != "HEAD" {
+		writeSimpleResponse(wr, 405, "GET, HEAD")
+		return
+	}
+	name, ok := fsrv.fileName(r)
+	if !ok {
+		writeSimpleResponse(wr, 404, "")
+		return
+	}
+	f, info, err := fsrv.open(name)
+	if err != nil {
+		writeSimpleResponse(wr, 404, "")
+		return
+	}
+	defer f.Close()
+	if info.IsDir() {
+		if len(r.Path) == 0 || r.Path[len(r.Path)-1] != '/' {
+			location := (&url.URL{Path: string(r.Path) + "/", RawQuery: string(r.QueryString)}).String()
+			wr.WriteStatus(301)
+			wr.WriteOtherHeader("location", location)
+			wr.WriteContentLength(0)
+			return
+		}
+		_ = f.Close()
+		index := fsrv.IndexFile
+		if index == "" {
+			index = "index.html"
+		}
+		if f, info, err = fsrv.open(path.Join(name, index)); err != nil {
+			writeSimpleResponse(wr, 404, "")
+			return
+		}
+		defer f.Close() // Deferred close above is bound to directory
+		if info.IsDir() {
+			writeSimpleResponse(wr, 404, "")
+			return
+		}
+		name = path.Join(name, index)
+	}
+	serveContent(wr, r, name, f, info)
+}
+
+// fileName returns slash separated name in FS, rejecting traversal. Percent-decoding was done
+// in place by parser, so encoded dots and slashes are already plain here.
+func (fsrv *FileServer) fileName(r *Request) (string, bool) {
+	p := string(r.Path)
+	if fsrv.PathParam != "" {
+		p = "/" + string(r.Param(fsrv.PathParam))
+	} else if fsrv.Prefix != "" {
+		if !strings.HasPrefix(p, fsrv.Prefix) {
+			return "", false
+		}
+		rest := p[len(fsrv.Prefix):]
+		if rest != "" && rest[0] != '/' && !strings.HasSuffix(fsrv.Prefix, "/") {
+			return "", false // Sibling like "/staticfoo" of "/static"
+		}
+		p = "/" + strings.TrimPrefix(rest, "/")
+	}
+	if len(p) == 0 || p[0] != '/' || strings.IndexByte(p, 0) >= 0 || strings.IndexByte(p, '\\') >= 0 {
+		return "", false
+	}
+	name := strings.TrimSuffix(p[1:], "/")
+	if name == "" {
+		return ".", true
+	}
+	return name, fs.ValidPath(name) // Rejects "..", "." and empty elements
+}
+
+func (fsrv *FileServer) open(name string) (fs.File, fs.FileInfo, error) {
+	f, err := fsrv.FS.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+func fileETag(info fs.FileInfo) string {
+	return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16) + `"`
+}
+
+// etagMatch tells if etag is in if-none-match list, "*" matches any
+func etagMatch(list []byte, etag string, weak bool) bool {
+	for len(list) != 0 {
+		var item []byte
+		if comma := bytes.IndexByte(list, ','); comma >= 0 {
+			item, list = trimSP(list[:comma]), list[comma+1:]
+		} else {
+			item, list = trimSP(list), nil
+		}
+		if string(item) == "*" {
+			return true
+		}
+		if weak && bytes.HasPrefix(item, []byte("W/")) {
+			item = item[2:]
+		}
+		if string(item) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func contentType(name string, f fs.File) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	seeker, ok := f.(io.Seeker)
+	if !ok {
+		return "application/octet-stream"
+	}
+	var sniff [512]byte
+	n, _ := io.ReadFull(f, sniff[:])
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(sniff[:n])
+}
+
+func serveContent(wr ResponseWriter, r *Request, name string, f fs.File, info fs.FileInfo) {
+	etag := fileETag(info)
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	lastModified := string(appendTime(nil, modTime))
+	size := info.Size()
+
+	notModified := false
+	if inm := r.HeaderLower("if-none-match"); inm != nil {
+		notModified = etagMatch(inm, etag, true)
+	} else if ims := r.HeaderLower("if-modified-since"); ims != nil {
+		t, err := http.ParseTime(string(ims))
+		notModified = err == nil && !modTime.After(t)
+	}
+	if notModified {
+		wr.WriteStatus(304)
+		wr.WriteOtherHeader("etag", etag)
+		wr.WriteOtherHeader("last-modified", lastModified)
+		return
+	}
+
+	var ranges []byte
+	if _, seekable := f.(io.Seeker); seekable && ifRangeMatch(r.HeaderLower("if-range"), etag, modTime) {
+		ranges = r.HeaderLower("range")
+	}
+	var rangesScratch [4]byteRange
+	parsed, satisfiable := parseRanges(ranges, size, rangesScratch[:0])
+	if !satisfiable {
+		wr.WriteStatus(416)
+		wr.WriteOtherHeader("content-range", "bytes */"+strconv.FormatInt(size, 10))
+		wr.WriteContentLength(0)
+		return
+	}
+	ctype := contentType(name, f)
+	head := string(r.Method) == "HEAD"
+	if len(parsed) == 0 {
+		writeFileHeaders(wr, 200, etag, lastModified)
+		wr.WriteOtherHeader("content-type", ctype)
+		wr.WriteContentLength(size)
+		if !head {
+			copyFileRange(wr, f, 0, size)
+		}
+		return
+	}
+	if len(parsed) == 1 {
+		rng := parsed[0]
+		writeFileHeaders(wr, 206, etag, lastModified)
+		wr.WriteOtherHeader("content-type", ctype)
+		wr.WriteOtherHeader("content-range", rng.contentRange(size))
+		wr.WriteContentLength(rng.length)
+		if !head {
+			copyFileRange(wr, f, rng.start, rng.length)
+		}
+		return
+	}
+	boundary := randomBoundary()
+	var total int64
+	for _, rng := range parsed {
+		total += int64(len(partHeader(boundary, ctype, rng, size))) + rng.length
+	}
+	total += int64(len(multipartEnd(boundary)))
+	writeFileHeaders(wr, 206, etag, lastModified)
+	wr.WriteOtherHeader("content-type", "multipart/byteranges; boundary="+boundary)
+	wr.WriteContentLength(total)
+	if head {
+		return
+	}
+	for _, rng := range parsed {
+		if _, err := io.WriteString(wr, partHeader(boundary, ctype, rng, size)); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		copyFileRange(wr, f, rng.start, rng.length)
+	}
+	_, _ = io.WriteString(wr, multipartEnd(boundary))
+}
+
+func writeFileHeaders(wr ResponseWriter, statusCode int, etag string, lastModified string) {
+	wr.WriteStatus(statusCode)
+	wr.WriteOtherHeader("accept-ranges", "bytes")
+	wr.WriteOtherHeader("etag", etag)
+	wr.WriteOtherHeader("last-modified", lastModified)
+}
+
+// copyFileRange writes length bytes from start. io.CopyN wraps f in a single LimitedReader, which
+// Client.ReadFrom unwraps, so large files use sendfile.
+// Content length is already written, so short copy can only be reported by aborting connection.
+func copyFileRange(wr ResponseWriter, f fs.File, start int64, length int64) {
+	if seeker, ok := f.(io.Seeker); ok {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if _, err := io.CopyN(wr, f, length); err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ifRangeMatch tells if range header applies, if-range is strong etag or exact date
+func ifRangeMatch(ifRange []byte, etag string, modTime time.Time) bool {
+	if ifRange == nil {
+		return true
+	}
+	if len(ifRange) != 0 && ifRange[0] == '"' {
+		return string(ifRange) == etag
+	}
+	t, err := http.ParseTime(string(ifRange))
+	return err == nil && t.Equal(modTime)
+}
+
+// parseRanges parses "bytes=" range header against size, appending to ranges.
+// Returns nil ranges for whole content, false if nothing is satisfiable (416).
+// Invalid or unknown headers are ignored, as RFC 7233 allows.
+func parseRanges(header []byte, size int64, ranges []byteRange) ([]byteRange, bool) {
+	const prefix = "bytes="
+	if len(header) < len(prefix) || string(header[:len(prefix)]) != prefix {
+		return nil, true
+	}
+	list := header[len(prefix):]
+	valid := false
+	for len(list) != 0 {
+		var spec []byte
+		if comma := bytes.IndexByte(list, ','); comma >= 0 {
+			spec, list = trimSP(list[:comma]), list[comma+1:]
+		} else {
+			spec, list = trimSP(list), nil
+		}
+		if len(spec) == 0 {
+			continue
+		}
+		dash := bytes.IndexByte(spec, '-')
+		if dash < 0 {
+			return nil, true
+		}
+		var rng byteRange
+		if dash == 0 { // Suffix, last N bytes
+			n, ok := parseRangeInt(spec[1:])
+			if !ok {
+				return nil, true
+			}
+			valid = true
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			rng = byteRange{start: size - n, length: n}
+		} else {
+			start, ok := parseRangeInt(spec[:dash])
+			if !ok {
+				return nil, true
+			}
+			end := size - 1
+			if dash != len(spec)-1 {
+				if end, ok = parseRangeInt(spec[dash+1:]); !ok || end < start {
+					return nil, true
+				}
+			}
+			valid = true
+			if start >= size {
+				continue
+			}
+			if end >= size {
+				end = size - 1
+			}
+			rng = byteRange{start: start, length: end - start + 1}
+		}
+		if len(ranges) == maxRanges {
+			return nil, true
+		}
+		ranges = append(ranges, rng)
+	}
+	if !valid {
+		return nil, true
+	}
+	if len(ranges) == 0 {
+		return nil, false
+	}
+	return ranges, true
+}
+
+func parseRangeInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		if !isDigit(c) {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	return n, true
+}
+
+func (rng byteRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(rng.start, 10) + "-" + strconv.FormatInt(rng.start+rng.length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+func randomBoundary() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func partHeader(boundary string, ctype string, rng byteRange, size int64) string {
+	return "\r\n--" + boundary + "\r\ncontent-type: " + ctype + "\r\ncontent-range: " + rng.contentRange(size) + "\r\n\r\n"
+}
+
+func multipartEnd(boundary string) string {
+	return "\r\n--" + boundary + "--\r\n"
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var bigFile = bytes.Repeat([]byte("abcdefghij"), 50000) // Larger than sendfileMinSize
+
+func startFileServer(t *testing.T) string {
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"a.txt":          []byte("0123456789"),
+		"noext":          []byte("<html><body>hi</body></html>"),
+		"sub/index.html": []byte("idx"),
+		"big.bin":        bigFile,
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), "secret"), []byte("s"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fsrv := NewFileServer(dir)
+	fsrv.Prefix = "/static"
+	return startServer(t, &Server{handler: fsrv.Serve, H2C: true})
+}
+
+func getFile(t *testing.T, conn net.Conn, path string, headers string) (*http.Response, string) {
+	t.Helper()
+	return roundTrip(t, conn, "GET "+path+" HTTP/1.1\r\nHost: x\r\n"+headers+"\r\n")
+}
+
+func TestFileServerContent(t *testing.T) {
+	conn := dial(t, startFileServer(t))
+	resp, body := getFile(t, conn, "/static/a.txt", "")
+	if resp.StatusCode != 200 || body != "0123456789" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatal(resp.Status, body, resp.Header)
+	}
+	if resp, _ = getFile(t, conn, "/static/noext", ""); !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatal(resp.Header)
+	}
+	if resp, _ = getFile(t, conn, "/static/sub?x=1", ""); resp.StatusCode != 301 || resp.Header.Get("Location") != "/static/sub/?x=1" {
+		t.Fatal(resp.Status, resp.Header)
+	}
+	if _, body = getFile(t, conn, "/static/sub/", ""); body != "idx" {
+		t.Fatal(body)
+	}
+	if _, body = getFile(t, conn, "/static/big.bin", ""); body != string(bigFile) {
+		t.Fatal(len(body))
+	}
+	resp, _ = roundTrip(t, conn, "POST /static/a.txt HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n")
+	if resp.StatusCode != 405 || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Fatal(resp.Status, resp.Header)
+	}
+}
+
+func TestFileServerRejectsTraversal(t *testing.T) {
+	conn := dial(t, startFileServer(t))
+	for _, path := range []string{"/static/../secret", "/static/%2e%2e/secret", "/static/sub/%2e%2e%2f..%2fsecret", "/static/a.txt%00", "/other/a.txt"} {
+		if resp, _ := getFile(t, conn, path, ""); resp.StatusCode != 404 {
+			t.Errorf("%s: %d", path, resp.StatusCode)
+		}
+	}
+}
+
+// Prefix matches whole path segments, so siblings of prefix do not map into directory
+func TestFileServerPrefixBoundary(t *testing.T) {
+	conn := dial(t, startFileServer(t))
+	for _, path := range []string{"/statica.txt", "/static-sub/index.html", "/staticsub/"} {
+		if resp, body := getFile(t, conn, path, ""); resp.StatusCode != 404 {
+			t.Errorf("%s: %d %q", path, resp.StatusCode, body)
+		}
+	}
+	if resp, body := getFile(t, conn, "/static", ""); resp.StatusCode != 301 || resp.Header.Get("Location") != "/static/" {
+		t.Fatalf("%d %q %v", resp.StatusCode, body, resp.Header)
+	}
+}
+
+func TestFileServerConditional(t *testing.T) {
+	conn := dial(t, startFileServer(t))
+	resp, _ := getFile(t, conn, "/static/a.txt", "")
+	etag, lastModified := resp.Header.Get("Etag"), resp.Header.Get("Last-Modified")
+	for _, headers := range []string{"If-None-Match: W/" + etag, "If-None-Match: \"x\", " + etag, "If-Modified-Since: " + lastModified} {
+		if resp, body := getFile(t, conn, "/static/a.txt", headers+"\r\n"); resp.StatusCode != 304 || body != "" {
+			t.Errorf("%s: %d", headers, resp.StatusCode)
+		}
+	}
+	if resp, _ := getFile(t, conn, "/static/a.txt", "If-None-Match: \"x\"\r\n"); resp.StatusCode != 200 {
+		t.Fatal(resp.StatusCode)
+	}
+	// If-Range with stale validator ignores Range
+	if resp, body := getFile(t, conn, "/static/a.txt", "Range: bytes=2-4\r\nIf-Range: \"stale\"\r\n"); resp.StatusCode != 200 || body != "0123456789" {
+		t.Fatal(resp.StatusCode, body)
+	}
+	if resp, body := getFile(t, conn, "/static/a.txt", "Range: bytes=2-4\r\nIf-Range: "+etag+"\r\n"); resp.StatusCode != 206 || body != "234" {
+		t.Fatal(resp.StatusCode, body)
+	}
+}
+
+func TestFileServerRanges(t *testing.T) {
+	conn := dial(t, startFileServer(t))
+	for _, tc := range []struct{ rng, body, contentRange string }{
+		{"2-4", "234", "bytes 2-4/10"},
+		{"-3", "789", "bytes 7-9/10"},
+		{"8-", "89", "bytes 8-9/10"},
+		{"8-100", "89", "bytes 8-9/10"},
+	} {
+		resp, body := getFile(t, conn, "/static/a.txt", "Range: bytes="+tc.rng+"\r\n")
+		if resp.StatusCode != 206 || body != tc.body || resp.Header.Get("Content-Range") != tc.contentRange {
+			t.Errorf("%s: %d %q %q", tc.rng, resp.StatusCode, body, resp.Header.Get("Content-Range"))
+		}
+	}
+	if resp, _ := getFile(t, conn, "/static/a.txt", "Range: bytes=20-\r\n"); resp.StatusCode != 416 || resp.Header.Get("Content-Range") != "bytes */10" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+	resp, body := getFile(t, conn, "/static/a.txt", "Range: bytes=5-6, 0-1\r\n")
+	_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Range")+"="+string(b))
+	}
+	if resp.StatusCode != 206 || fmt.Sprint(parts) != "[bytes 5-6/10=56 bytes 0-1/10=01]" || resp.ContentLength != int64(len(body)) {
+		t.Fatal(resp.StatusCode, parts)
+	}
+}
+
+// Large range is sent by sendfile from file offset, connection must stay usable after it
+func TestFileServerLargeRangeAtOffset(t *testing.T) {
+	conn := dial(t, startFileServer(t))
+	for _, tc := range []struct{ start, end int }{{100, 399999}, {123457, len(bigFile) - 1}, {1, 65537}} {
+		resp, body := getFile(t, conn, "/static/big.bin", fmt.Sprintf("Range: bytes=%d-%d\r\n", tc.start, tc.end))
+		if resp.StatusCode != 206 || body != string(bigFile[tc.start:tc.end+1]) {
+			t.Fatal(tc, resp.StatusCode, len(body))
+		}
+	}
+	if _, body := getFile(t, conn, "/static/a.txt", ""); body != "0123456789" {
+		t.Fatal(body)
+	}
+}
+
+func TestFileServerHead(t *testing.T) {
+	conn := dial(t, startFileServer(t))
+	br := bufio.NewReader(conn)
+	for _, headers := range []string{"", "Range: bytes=100-399999\r\n", "Range: bytes=0-1,5-6\r\n"} {
+		_, _ = io.WriteString(conn, "HEAD /static/big.bin HTTP/1.1\r\nHost: x\r\n"+headers+"\r\n")
+		resp, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+		if err != nil || resp.ContentLength <= 0 {
+			t.Fatal(resp, err)
+		}
+	}
+	// Nothing was sent after the headers, so the next response starts right away
+	_, _ = io.WriteString(conn, "GET /static/a.txt HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(resp.Body); string(b) != "0123456789" {
+		t.Fatalf("%q", b)
+	}
+}
+
+// Generic handler writes body for HEAD as for GET, it must not be sent
+func TestHeadBodyNotSent(t *testing.T) {
+	h := func(wr ResponseWriter, r *Request) {
+		if string(r.Path) == "/length" {
+			wr.WriteContentLength(5)
+		}
+		_, _ = wr.Write([]byte("hello"))
+		if string(r.Path) == "/copy" {
+			_, _ = io.Copy(wr, bytes.NewReader(bigFile))
+		}
+	}
+	conn := dial(t, startServer(t, &Server{handler: h}))
+	br := bufio.NewReader(conn)
+	for _, path := range []string{"/length", "/chunked", "/copy"} {
+		_, _ = io.WriteString(conn, "HEAD "+path+" HTTP/1.1\r\n\r\n")
+		resp, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+		if err != nil || resp.StatusCode != 200 || path == "/length" && resp.ContentLength != 5 {
+			t.Fatal(path, resp, err)
+		}
+	}
+	_, _ = io.WriteString(conn, "GET /length HTTP/1.1\r\n\r\n")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(resp.Body); string(b) != "hello" {
+		t.Fatalf("%q", b)
+	}
+}
+
+func TestFileServerHeadHTTP2(t *testing.T) {
+	addr := startFileServer(t)
+	resp, err := h2cClient().Head("http://" + addr + "/static/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ContentLength != int64(len(bigFile)) {
+		t.Fatal(resp.StatusCode, resp.ContentLength)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+const defaultMaxFormSize = 1024 * 1024
+const maxReusedFormBuffer = 64 * 1024 // Larger buffers are not kept by idle connections
+
+var ErrFormTooLarge = errors.New("Form body too large")
+
+// ParseForm reads application/x-www-form-urlencoded body into PostArgs, other content types
+// and bodies are left unread. maxSize 0 means defaultMaxFormSize, larger body is ErrFormTooLarge.
+// Called by PostArgs and FormValue with default size, call it before them to set another limit.
+func (r *Request) ParseForm(maxSize int64) error {
+	if r.formParsed {
+		return r.formErr
+	}
+	r.formParsed = true
+	r.postArgs.kvs = r.postArgs.kvs[:0]
+	if string(r.ContentTypeMime) != "application/x-www-form-urlencoded" {
+		return nil
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxFormSize
+	}
+	if r.ContentLength > maxSize {
+		r.formErr = ErrFormTooLarge
+		return r.formErr
+	}
+	buf := r.formBuffer[:0]
+	if r.ContentLength > 0 && int64(cap(buf)) < r.ContentLength {
+		buf = make([]byte, 0, r.ContentLength) // Decoded body may be larger, append will grow it
+	}
+	body := r.Body()
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := body.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if int64(len(buf)) > maxSize {
+			r.formErr = ErrFormTooLarge
+			return r.formErr
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			r.formErr = err
+			return err
+		}
+	}
+	if cap(buf) <= maxReusedFormBuffer {
+		r.formBuffer = buf // Reused by the next request of connection
+	}
+	r.postArgs.Parse(buf)
+	return nil
+}
+
+// PostArgs returns arguments of urlencoded form body, empty if body is not a form or invalid
+func (r *Request) PostArgs() *Args {
+	_ = r.ParseForm(0)
+	return &r.postArgs
+}
+
+// FormValue returns the first value of key from form body, then from query string, nil if not found
+func (r *Request) FormValue(key string) []byte {
+	args := r.Args() // Query string is parsed before body is read
+	if value := r.PostArgs().Peek(key); value != nil {
+		return value
+	}
+	return args.Peek(key)
+}
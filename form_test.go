@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func formHandler(wr ResponseWriter, r *Request) {
+	if string(r.Path) == "/small" {
+		if err := r.ParseForm(10); errors.Is(err, ErrFormTooLarge) {
+			writeSimpleResponse(wr, 413, "")
+			return
+		}
+	}
+	result := fmt.Sprintf("%s|%s|%s|%d", r.FormValue("a"), r.FormValue("q"), r.FormValue("b"), r.PostArgs().Len())
+	wr.WriteContentLength(int64(len(result)))
+	_, _ = wr.Write([]byte(result))
+}
+
+func TestFormValue(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: formHandler}))
+	for _, tc := range []struct {
+		path        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"/?a=query&q=1", "application/x-www-form-urlencoded", "a=body+v&b=%41", "body v|1|A|2"},
+		{"/?a=query", "Application/X-WWW-Form-Urlencoded; charset=utf-8", "a=b", "b|||1"},
+		{"/?a=query", "text/plain", "a=b", "query|||0"},
+		{"/", "application/x-www-form-urlencoded", "", "|||0"},
+	} {
+		req := fmt.Sprintf("POST %s HTTP/1.1\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s", tc.path, tc.contentType, len(tc.body), tc.body)
+		if resp, got := roundTrip(t, conn, req); resp.StatusCode != 200 || got != tc.want {
+			t.Fatalf("%s %q: got %d %q, want %q", tc.path, tc.body, resp.StatusCode, got, tc.want)
+		}
+	}
+}
+
+// Key only in query string must be found after large form body was read
+func TestFormValueQueryOnlyKey(t *testing.T) {
+	addr := startServer(t, &Server{handler: formHandler, H2C: true})
+	conn := dial(t, addr)
+	body := "b=" + strings.Repeat("x", 10*incomingBufferSize)
+	want := "|from%20query|" + body[2:] + "|1"
+	for _, framing := range []string{
+		fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body),
+		fmt.Sprintf("Transfer-Encoding: chunked\r\n\r\n%s", oneChunk([]byte(body))),
+	} {
+		req := "POST /?q=from%2520query HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\n" + framing
+		if resp, got := roundTrip(t, conn, req); resp.StatusCode != 200 || got != want {
+			t.Fatalf("got %d %q", resp.StatusCode, got[:min(len(got), 40)])
+		}
+	}
+	resp, err := h2cClient().Post("http://"+addr+"/?q=from%2520query", "application/x-www-form-urlencoded", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, _ := io.ReadAll(resp.Body); resp.ProtoMajor != 2 || string(got) != want {
+		t.Fatalf("HTTP/%d: %q", resp.ProtoMajor, got[:min(len(got), 40)])
+	}
+}
+
+func TestFormChunked(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: formHandler}))
+	resp, got := roundTrip(t, conn, "POST / HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\nTransfer-Encoding: chunked\r\n\r\n3\r\na=1\r\n4\r\n&b=2\r\n0\r\n\r\n")
+	if resp.StatusCode != 200 || got != "1||2|2" {
+		t.Fatalf("%d %q", resp.StatusCode, got)
+	}
+}
+
+func TestFormTooLarge(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: formHandler}))
+	for _, framing := range []string{
+		"Content-Length: 12\r\n\r\na=0123456789",
+		"Transfer-Encoding: chunked\r\n\r\n" + oneChunk([]byte("a=0123456789")), // Size is not known in advance
+	} {
+		resp, _ := roundTrip(t, conn, "POST /small HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\n"+framing)
+		if resp.StatusCode != 413 {
+			t.Fatalf("%q: %d", framing, resp.StatusCode)
+		}
+	}
+}
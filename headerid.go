@@ -0,0 +1,276 @@
+package main
+
+import (
+	"strings"
+)
+
+// HeaderID identifies header name known to parser, stored in HeaderKV, so lookups compare integers
+type HeaderID uint8
+
+const (
+	HEADER_UNKNOWN HeaderID = iota
+	HEADER_ACCEPT
+	HEADER_ACCEPT_CHARSET
+	HEADER_ACCEPT_ENCODING
+	HEADER_ACCEPT_LANGUAGE
+	HEADER_ACCEPT_RANGES
+	HEADER_AUTHORIZATION
+	HEADER_CACHE_CONTROL
+	HEADER_CONNECTION
+	HEADER_CONTENT_DISPOSITION
+	HEADER_CONTENT_ENCODING
+	HEADER_CONTENT_LENGTH
+	HEADER_CONTENT_RANGE
+	HEADER_CONTENT_TYPE
+	HEADER_COOKIE
+	HEADER_DATE
+	HEADER_ETAG
+	HEADER_EXPECT
+	HEADER_FORWARDED
+	HEADER_HOST
+	HEADER_HTTP2_SETTINGS
+	HEADER_IF_MATCH
+	HEADER_IF_MODIFIED_SINCE
+	HEADER_IF_NONE_MATCH
+	HEADER_IF_RANGE
+	HEADER_IF_UNMODIFIED_SINCE
+	HEADER_KEEP_ALIVE
+	HEADER_LAST_MODIFIED
+	HEADER_LOCATION
+	HEADER_ORIGIN
+	HEADER_PRAGMA
+	HEADER_PROXY_AUTHORIZATION
+	HEADER_PROXY_CONNECTION
+	HEADER_RANGE
+	HEADER_REFERER
+	HEADER_SEC_WEBSOCKET_EXTENSIONS
+	HEADER_SEC_WEBSOCKET_KEY
+	HEADER_SEC_WEBSOCKET_PROTOCOL
+	HEADER_SEC_WEBSOCKET_VERSION
+	HEADER_SERVER
+	HEADER_SET_COOKIE
+	HEADER_TE
+	HEADER_TRAILER
+	HEADER_TRANSFER_ENCODING
+	HEADER_UPGRADE
+	HEADER_USER_AGENT
+	HEADER_VARY
+	HEADER_WWW_AUTHENTICATE
+	HEADER_X_FORWARDED_FOR
+	HEADER_X_FORWARDED_HOST
+	HEADER_X_FORWARDED_PROTO
+	HEADER_X_REAL_IP
+	HEADER_X_REQUESTED_WITH
+	HEADER_USER // The first ID returned by Server.RegisterHeader
+)
+
+const maxHeaderIDs = 128
+const headerIndexFar = 255 // Position in Request.headerIndex of header too far for uint8, found by scan
+
+var knownHeaderNames = [HEADER_USER]string{
+	HEADER_ACCEPT:                   "accept",
+	HEADER_ACCEPT_CHARSET:           "accept-charset",
+	HEADER_ACCEPT_ENCODING:          "accept-encoding",
+	HEADER_ACCEPT_LANGUAGE:          "accept-language",
+	HEADER_ACCEPT_RANGES:            "accept-ranges",
+	HEADER_AUTHORIZATION:            "authorization",
+	HEADER_CACHE_CONTROL:            "cache-control",
+	HEADER_CONNECTION:               "connection",
+	HEADER_CONTENT_DISPOSITION:      "content-disposition",
+	HEADER_CONTENT_ENCODING:         "content-encoding",
+	HEADER_CONTENT_LENGTH:           "content-length",
+	HEADER_CONTENT_RANGE:            "content-range",
+	HEADER_CONTENT_TYPE:             "content-type",
+	HEADER_COOKIE:                   "cookie",
+	HEADER_DATE:                     "date",
+	HEADER_ETAG:                     "etag",
+	HEADER_EXPECT:                   "expect",
+	HEADER_FORWARDED:                "forwarded",
+	HEADER_HOST:                     "host",
+	HEADER_HTTP2_SETTINGS:           "http2-settings",
+	HEADER_IF_MATCH:                 "if-match",
+	HEADER_IF_MODIFIED_SINCE:        "if-modified-since",
+	HEADER_IF_NONE_MATCH:            "if-none-match",
+	HEADER_IF_RANGE:                 "if-range",
+	HEADER_IF_UNMODIFIED_SINCE:      "if-unmodified-since",
+	HEADER_KEEP_ALIVE:               "keep-alive",
+	HEADER_LAST_MODIFIED:            "last-modified",
+	HEADER_LOCATION:                 "location",
+	HEADER_ORIGIN:                   "origin",
+	HEADER_PRAGMA:                   "pragma",
+	HEADER_PROXY_AUTHORIZATION:      "proxy-authorization",
+	HEADER_PROXY_CONNECTION:         "proxy-connection",
+	HEADER_RANGE:                    "range",
+	HEADER_REFERER:                  "referer",
+	HEADER_SEC_WEBSOCKET_EXTENSIONS: "sec-websocket-extensions",
+	HEADER_SEC_WEBSOCKET_KEY:        "sec-websocket-key",
+	HEADER_SEC_WEBSOCKET_PROTOCOL:   "sec-websocket-protocol",
+	HEADER_SEC_WEBSOCKET_VERSION:    "sec-websocket-version",
+	HEADER_SERVER:                   "server",
+	HEADER_SET_COOKIE:               "set-cookie",
+	HEADER_TE:                       "te",
+	HEADER_TRAILER:                  "trailer",
+	HEADER_TRANSFER_ENCODING:        "transfer-encoding",
+	HEADER_UPGRADE:                  "upgrade",
+	HEADER_USER_AGENT:               "user-agent",
+	HEADER_VARY:                     "vary",
+	HEADER_WWW_AUTHENTICATE:         "www-authenticate",
+	HEADER_X_FORWARDED_FOR:          "x-forwarded-for",
+	HEADER_X_FORWARDED_HOST:         "x-forwarded-host",
+	HEADER_X_FORWARDED_PROTO:        "x-forwarded-proto",
+	HEADER_X_REAL_IP:                "x-real-ip",
+	HEADER_X_REQUESTED_WITH:         "x-requested-with",
+}
+
+// headerTable is perfect hash of names to IDs, lookup is one multiplication and one comparison.
+// Hash of length, first, middle and last byte is used, unless two names share them,
+// then table falls back to hashing all bytes.
+type headerTable struct {
+	names   []string // By ID
+	entries []headerEntry
+	seed    uint32
+	shift   uint32
+	full    bool
+}
+
+type headerEntry struct {
+	name string
+	id   HeaderID
+}
+
+var defaultHeaderTable = newHeaderTable(knownHeaderNames[:])
+
+func newHeaderTable(names []string) *headerTable {
+	t := &headerTable{names: names}
+	var seen = map[uint32]string{}
+	for _, name := range names[HEADER_UNKNOWN+1:] {
+		tuple := headerTuple([]byte(name))
+		if other, ok := seen[tuple]; ok && other != name {
+			t.full = true
+		}
+		seen[tuple] = name
+	}
+	for bits := uint32(6); bits <= 16; bits++ {
+		t.entries = make([]headerEntry, 1<<bits)
+		t.shift = 32 - bits
+		seed := uint32(2654435769) // Golden ratio, next seeds are deterministic too
+		for attempt := 0; attempt < 10000; attempt++ {
+			t.seed = seed | 1
+			if t.fill() {
+				return t
+			}
+			seed = seed*1664525 + 1013904223
+		}
+	}
+	panic("Cannot build perfect hash of header names")
+}
+
+// fill places names into entries, false on collision
+func (t *headerTable) fill() bool {
+	for i := range t.entries {
+		t.entries[i] = headerEntry{}
+	}
+	for id, name := range t.names {
+		if id == int(HEADER_UNKNOWN) {
+			continue
+		}
+		e := &t.entries[t.hash([]byte(name))]
+		if e.name != "" {
+			return false
+		}
+		*e = headerEntry{name: name, id: HeaderID(id)}
+	}
+	return true
+}
+
+func headerTuple(key []byte) uint32 {
+	n := len(key)
+	return uint32(key[0]) | uint32(key[n>>1])<<8 | uint32(key[n-1])<<16 | uint32(n)<<24
+}
+
+func (t *headerTable) hash(key []byte) uint32 {
+	var h uint32
+	if t.full {
+		h = 2166136261 // FNV-1a
+		for _, c := range key {
+			h = (h ^ uint32(c)) * 16777619
+		}
+	} else {
+		h = headerTuple(key)
+	}
+	return (h * t.seed) >> t.shift
+}
+
+// lookup returns ID of lowercase key, HEADER_UNKNOWN if not known
+func (t *headerTable) lookup(key []byte) HeaderID {
+	if len(key) == 0 {
+		return HEADER_UNKNOWN
+	}
+	e := &t.entries[t.hash(key)]
+	if len(e.name) == len(key) && e.name == string(key) {
+		return e.id
+	}
+	return HEADER_UNKNOWN
+}
+
+func (c *Client) headerTable() *headerTable {
+	if c.server != nil && c.server.headerTable != nil {
+		return c.server.headerTable
+	}
+	return defaultHeaderTable
+}
+
+// RegisterHeader makes parser assign ID to header name, so Request.HeaderByID finds it quickly.
+// Returns existing ID for known names. Panics after serving started, because connections read
+// the table without lock. At most maxHeaderIDs-HEADER_USER names can be registered.
+func (s *Server) RegisterHeader(name string) HeaderID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		panic("RegisterHeader called after serving started")
+	}
+	t := s.headerTable
+	if t == nil {
+		t = defaultHeaderTable
+	}
+	lowerName := strings.ToLower(name)
+	if id := t.lookup([]byte(lowerName)); id != HEADER_UNKNOWN {
+		return id
+	}
+	if len(t.names) == maxHeaderIDs {
+		panic("Too many registered headers")
+	}
+	names := append(t.names[:len(t.names):len(t.names)], lowerName)
+	s.headerTable = newHeaderTable(names)
+	return HeaderID(len(names) - 1)
+}
+
+func (kv HeaderKV) ID() HeaderID { return kv.id }
+
+// HeaderByID returns value of the last header with id, nil if not found.
+// Index of headers by ID is built on the first call and after Headers change.
+func (r *Request) HeaderByID(id HeaderID) []byte {
+	if id == HEADER_UNKNOWN || int(id) >= maxHeaderIDs {
+		return nil
+	}
+	if r.headerIndexLen != len(r.Headers) {
+		r.headerIndex = [maxHeaderIDs]uint8{}
+		for i := range r.Headers {
+			r.headerIndex[r.Headers[i].id] = uint8(min(i+1, headerIndexFar))
+		}
+		r.headerIndexLen = len(r.Headers)
+	}
+	switch pos := r.headerIndex[id]; pos {
+	case 0:
+		return nil
+	case headerIndexFar:
+		for i := len(r.Headers) - 1; i >= 0; i-- {
+			if r.Headers[i].id == id {
+				return r.Headers[i].value
+			}
+		}
+		return nil
+	default:
+		return r.Headers[pos-1].value
+	}
+}
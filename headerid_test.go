@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestHeaderTableLookup(t *testing.T) {
+	for id, name := range knownHeaderNames {
+		if id == int(HEADER_UNKNOWN) {
+			continue
+		}
+		if got := defaultHeaderTable.lookup([]byte(name)); got != HeaderID(id) {
+			t.Errorf("%q: got %d, want %d", name, got, id)
+		}
+	}
+	for _, name := range []string{"", "x", "Accept", "accep", "accepts", "x-forwarded-fo", "upgrade-insecure-requests"} {
+		if got := defaultHeaderTable.lookup([]byte(name)); got != HEADER_UNKNOWN {
+			t.Errorf("%q: got %d", name, got)
+		}
+	}
+}
+
+// Names with the same length, first, middle and last byte need hash of all bytes
+func TestHeaderTableFullHash(t *testing.T) {
+	names := append(knownHeaderNames[:len(knownHeaderNames):len(knownHeaderNames)], "abcde", "axcde")
+	table := newHeaderTable(names)
+	if !table.full {
+		t.Fatal("tuple collision not detected")
+	}
+	for id, name := range names[HEADER_UNKNOWN+1:] {
+		if got := table.lookup([]byte(name)); got != HeaderID(id+1) {
+			t.Errorf("%q: got %d, want %d", name, got, id+1)
+		}
+	}
+	if got := table.lookup([]byte("aycde")); got != HEADER_UNKNOWN {
+		t.Fatal(got)
+	}
+}
+
+func TestRegisterHeader(t *testing.T) {
+	s := &Server{H2C: true}
+	id := s.RegisterHeader("X-Request-ID")
+	if id != HEADER_USER || s.RegisterHeader("x-request-id") != id || s.RegisterHeader("Accept") != HEADER_ACCEPT {
+		t.Fatal(id)
+	}
+	if other := s.RegisterHeader("X-Tenant"); other != id+1 {
+		t.Fatal(other)
+	}
+	if defaultHeaderTable.lookup([]byte("x-request-id")) != HEADER_UNKNOWN {
+		t.Fatal("default table changed")
+	}
+	s.handler = func(wr ResponseWriter, r *Request) {
+		var ids []HeaderID // Of sent headers, client may add others and reorder them
+		for _, key := range []string{"accept", "x-request-id", "x-other"} {
+			for _, kv := range r.Headers {
+				if string(kv.Key()) == key {
+					ids = append(ids, kv.ID())
+				}
+			}
+		}
+		result := fmt.Sprintf("%s|%s|%s|%v", r.HeaderByID(id), r.HeaderLower("x-request-id"), r.Header("X-Request-Id"), ids)
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}
+	addr := startServer(t, s)
+	want := fmt.Sprintf("42|42|42|%v", []HeaderID{HEADER_ACCEPT, id, HEADER_UNKNOWN})
+	_, got := roundTrip(t, dial(t, addr), "GET / HTTP/1.1\r\nAccept: */*\r\nX-Request-Id: 42\r\nX-Other: 1\r\n\r\n")
+	if got != want {
+		t.Fatalf("HTTP/1.1: got %q, want %q", got, want)
+	}
+	req, _ := http.NewRequest("GET", "http://"+addr+"/", nil)
+	req.Header["Accept"] = []string{"*/*"}
+	req.Header["X-Request-Id"] = []string{"42"}
+	req.Header["X-Other"] = []string{"1"}
+	resp, err := h2cClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || string(b) != want {
+		t.Fatalf("HTTP/%d: got %q, want %q", resp.ProtoMajor, b, want)
+	}
+}
+
+func TestRegisterHeaderAfterServePanics(t *testing.T) {
+	s := &Server{handler: okHandler}
+	_, _ = roundTrip(t, dial(t, startServer(t, s)), "GET / HTTP/1.1\r\n\r\n") // Serving surely started
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic")
+		}
+	}()
+	s.RegisterHeader("X-Late")
+}
+
+// Positions above uint8 range are found by scan, the last header with id wins
+func TestHeaderByIDFarPositions(t *testing.T) {
+	r := &Request{headerIndexLen: -1}
+	for i := 0; i < 300; i++ {
+		r.Headers = append(r.Headers, HeaderKV{key: []byte("x-filler"), value: []byte("f")})
+	}
+	r.Headers[3] = HeaderKV{id: HEADER_ACCEPT, key: []byte("accept"), value: []byte("near")}
+	r.Headers[200] = HeaderKV{id: HEADER_ETAG, key: []byte("etag"), value: []byte("e")}
+	r.Headers[260] = HeaderKV{id: HEADER_ACCEPT, key: []byte("accept"), value: []byte("far")}
+	r.Headers[280] = HeaderKV{id: HEADER_RANGE, key: []byte("range"), value: []byte("r")}
+	for _, tc := range []struct {
+		id   HeaderID
+		want string
+	}{{HEADER_ACCEPT, "far"}, {HEADER_ETAG, "e"}, {HEADER_RANGE, "r"}, {HEADER_VARY, ""}} {
+		if got := r.HeaderByID(tc.id); string(got) != tc.want {
+			t.Errorf("%d: got %q, want %q", tc.id, got, tc.want)
+		}
+	}
+}
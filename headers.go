@@ -0,0 +1,78 @@
+package main
+
+func (kv HeaderKV) Key() []byte   { return kv.key } // Lowercase
+func (kv HeaderKV) Value() []byte { return kv.value }
+
+// HeaderLower returns value of the last header with lowerKey, nil if not found.
+// Parser lowercases keys in place, so this is a plain comparison, or index lookup for known names.
+func (r *Request) HeaderLower(lowerKey string) []byte {
+	table := r.headerTable
+	if table == nil {
+		table = defaultHeaderTable
+	}
+	if id := table.lookup([]byte(lowerKey)); id != HEADER_UNKNOWN {
+		return r.HeaderByID(id)
+	}
+	for i := len(r.Headers) - 1; i >= 0; i-- {
+		if string(r.Headers[i].key) == lowerKey {
+			return r.Headers[i].value
+		}
+	}
+	return nil
+}
+
+// Header returns value of the last header with name in any case, nil if not found.
+// Headers parsed into Request fields (host, origin, content-length, content-type, transfer-encoding,
+// connection, upgrade, sec-websocket-key, sec-websocket-version and basic authorization)
+// are not in Headers, use the fields. Headers named in connection are in HopByHopHeaders.
+func (r *Request) Header(name string) []byte {
+	if isLowerString(name) {
+		return r.HeaderLower(name)
+	}
+	for i := len(r.Headers) - 1; i >= 0; i-- {
+		if equalLower(r.Headers[i].key, name) {
+			return r.Headers[i].value
+		}
+	}
+	return nil
+}
+
+// HeaderValues appends values of all headers with name in any case to dst, in order of arrival.
+// Comma separated values in one header are not split. Pass scratch array to avoid allocation.
+func (r *Request) HeaderValues(dst [][]byte, name string) [][]byte {
+	for i := range r.Headers {
+		if equalLower(r.Headers[i].key, name) {
+			dst = append(dst, r.Headers[i].value)
+		}
+	}
+	return dst
+}
+
+// VisitHeaders calls f for every header in order of arrival, keys are lowercase
+func (r *Request) VisitHeaders(f func(key []byte, value []byte)) {
+	for i := range r.Headers {
+		f(r.Headers[i].key, r.Headers[i].value)
+	}
+}
+
+func isLowerString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// equalLower compares lowercase key with name in any case
+func equalLower(lowerKey []byte, name string) bool {
+	if len(lowerKey) != len(name) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if lowerKey[i] != toLower(name[i]) {
+			return false
+		}
+	}
+	return true
+}
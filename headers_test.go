@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func parsedRequest(t *testing.T, raw string) *Request {
+	t.Helper()
+	c := &Client{incomingBuffer: []byte(raw)}
+	if c.parse2() != "" {
+		t.Fatal(c.parseError)
+	}
+	return &c.request
+}
+
+func TestRequestHeader(t *testing.T) {
+	r := parsedRequest(t, "GET / HTTP/1.1\r\nHost: x\r\nX-Multi: a\r\nAccept: b\r\nx-multi: c, d\r\n\r\n")
+	for _, tc := range []struct {
+		name string
+		want []byte
+	}{
+		{"X-MULTI", []byte("c, d")}, // The last one
+		{"x-multi", []byte("c, d")},
+		{"accept", []byte("b")},
+		{"Accept", []byte("b")},
+		{"Host", nil}, // Parsed into Request.Host
+		{"X-Mult", nil},
+		{"x-multi-", nil},
+	} {
+		if got := r.Header(tc.name); string(got) != string(tc.want) || (got == nil) != (tc.want == nil) {
+			t.Errorf("%q: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	if got := fmt.Sprintf("%q", r.HeaderValues(nil, "x-Multi")); got != `["a" "c, d"]` {
+		t.Fatal(got)
+	}
+	var keys []string
+	r.VisitHeaders(func(key []byte, value []byte) { keys = append(keys, string(key)) })
+	if got := fmt.Sprint(keys); got != "[x-multi accept x-multi]" {
+		t.Fatal(got)
+	}
+	if string(r.Headers[1].Key()) != "accept" || string(r.Headers[1].Value()) != "b" {
+		t.Fatal(r.Headers[1])
+	}
+}
+
+func TestRequestHeaderNoAllocs(t *testing.T) {
+	r := parsedRequest(t, "GET / HTTP/1.1\r\nX-Multi: a\r\nAccept: b\r\nx-multi: c, d\r\n\r\n")
+	var scratch [4][]byte
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = r.Header("X-Multi")
+		_ = r.HeaderLower("accept")
+		_ = r.HeaderValues(scratch[:0], "X-Multi")
+	})
+	if allocs != 0 {
+		t.Fatal(allocs)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+)
+
+// HPACK https://tools.ietf.org/html/rfc7541
+// Decoder keeps dynamic table, encoder never adds to it, so it has no state to keep in sync with peer.
+
+type hpackField struct {
+	name  string
+	value string
+}
+
+type hpackEntry struct {
+	name  []byte
+	value []byte
+}
+
+const hpackDefaultTableSize = 4096
+const hpackEntryOverhead = 32
+
+var errHpack = errors.New("HPACK decoding error")
+
+var hpackStatic [len(hpackStaticTable)]hpackEntry
+var hpackStaticNames = map[string]int{}      // Name -> the first 1-based index
+var hpackStaticFields = map[hpackField]int{} // Name and value -> 1-based index
+
+type huffmanNode struct {
+	children [2]int16 // Index in huffmanTree, 0 means none (root is never a child)
+	symbol   int16    // -1 for internal nodes
+}
+
+var huffmanTree []huffmanNode
+
+func init() {
+	for i, f := range hpackStaticTable {
+		hpackStatic[i] = hpackEntry{name: []byte(f.name), value: []byte(f.value)}
+		if _, ok := hpackStaticNames[f.name]; !ok {
+			hpackStaticNames[f.name] = i + 1
+		}
+		hpackStaticFields[f] = i + 1
+	}
+	huffmanTree = append(huffmanTree, huffmanNode{symbol: -1})
+	for symbol, code := range huffmanCodes {
+		node := 0
+		for bit := int(huffmanCodeLen[symbol]) - 1; bit >= 0; bit-- {
+			b := (code >> uint(bit)) & 1
+			if huffmanTree[node].children[b] == 0 {
+				huffmanTree = append(huffmanTree, huffmanNode{symbol: -1})
+				huffmanTree[node].children[b] = int16(len(huffmanTree) - 1)
+			}
+			node = int(huffmanTree[node].children[b])
+		}
+		huffmanTree[node].symbol = int16(symbol)
+	}
+}
+
+// huffmanDecode appends decoded src to dst
+func huffmanDecode(dst []byte, src []byte) ([]byte, error) {
+	node := 0
+	padBits := 0 // Bits since the last symbol
+	padOnes := true
+	for _, c := range src {
+		for bit := 7; bit >= 0; bit-- {
+			b := (c >> uint(bit)) & 1
+			node = int(huffmanTree[node].children[b])
+			if node == 0 {
+				return dst, errHpack // EOS or invalid code
+			}
+			padBits++
+			padOnes = padOnes && b == 1
+			if symbol := huffmanTree[node].symbol; symbol >= 0 {
+				dst = append(dst, byte(symbol))
+				node = 0
+				padBits = 0
+				padOnes = true
+			}
+		}
+	}
+	if padBits > 7 || !padOnes { // Padding must be the most significant bits of EOS
+		return dst, errHpack
+	}
+	return dst, nil
+}
+
+// hpackReadInt reads integer with n-bit prefix from b[*pos:]
+func hpackReadInt(b []byte, pos *int, n uint) (uint64, error) {
+	if *pos >= len(b) {
+		return 0, errHpack
+	}
+	mask := uint64(1)<<n - 1
+	value := uint64(b[*pos]) & mask
+	*pos++
+	if value < mask {
+		return value, nil
+	}
+	for shift := uint(0); shift < 63; shift += 7 {
+		if *pos >= len(b) {
+			return 0, errHpack
+		}
+		c := b[*pos]
+		*pos++
+		value += uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, errHpack
+}
+
+func hpackAppendInt(dst []byte, firstByte byte, n uint, value uint64) []byte {
+	mask := uint64(1)<<n - 1
+	if value < mask {
+		return append(dst, firstByte|byte(value))
+	}
+	dst = append(dst, firstByte|byte(mask))
+	value -= mask
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+type hpackDecoder struct {
+	dynamic        []hpackEntry // Newest first
+	size           int
+	maxSize        int // Current, changed by size updates in header blocks
+	allowedMaxSize int // Our SETTINGS_HEADER_TABLE_SIZE
+	scratch        []byte
+}
+
+func newHpackDecoder() hpackDecoder {
+	return hpackDecoder{maxSize: hpackDefaultTableSize, allowedMaxSize: hpackDefaultTableSize}
+}
+
+func (d *hpackDecoder) entry(index uint64) (hpackEntry, error) {
+	if index == 0 {
+		return hpackEntry{}, errHpack
+	}
+	if index <= uint64(len(hpackStatic)) {
+		return hpackStatic[index-1], nil
+	}
+	index -= uint64(len(hpackStatic)) + 1
+	if index >= uint64(len(d.dynamic)) {
+		return hpackEntry{}, errHpack
+	}
+	return d.dynamic[index], nil
+}
+
+func (d *hpackDecoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) != 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.size -= len(last.name) + len(last.value) + hpackEntryOverhead
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+	}
+}
+
+func (d *hpackDecoder) add(name []byte, value []byte) {
+	size := len(name) + len(value) + hpackEntryOverhead
+	if size > d.maxSize {
+		d.dynamic = d.dynamic[:0]
+		d.size = 0
+		return
+	}
+	d.size += size
+	d.evict()
+	entry := hpackEntry{name: append([]byte(nil), name...), value: append([]byte(nil), value...)}
+	d.dynamic = append(d.dynamic, hpackEntry{})
+	copy(d.dynamic[1:], d.dynamic)
+	d.dynamic[0] = entry
+}
+
+// readString returns string from block or huffman decoded into scratch after scratchStart
+func (d *hpackDecoder) readString(block []byte, pos *int, scratchStart int) ([]byte, error) {
+	if *pos >= len(block) {
+		return nil, errHpack
+	}
+	huffman := block[*pos]&0x80 != 0
+	length, err := hpackReadInt(block, pos, 7)
+	if err != nil || length > uint64(len(block)-*pos) {
+		return nil, errHpack
+	}
+	raw := block[*pos : *pos+int(length)]
+	*pos += int(length)
+	if !huffman {
+		return raw, nil
+	}
+	d.scratch, err = huffmanDecode(d.scratch[:scratchStart], raw)
+	return d.scratch[scratchStart:], err
+}
+
+// decode calls emit for every field, name and value are valid only during the call
+func (d *hpackDecoder) decode(block []byte, emit func(name []byte, value []byte) error) error {
+	pos := 0
+	fieldSeen := false
+	for pos < len(block) {
+		c := block[pos]
+		fieldSeen = fieldSeen || c&0xe0 != 0x20
+		switch {
+		case c&0x80 != 0: // Indexed
+			index, err := hpackReadInt(block, &pos, 7)
+			if err != nil {
+				return err
+			}
+			entry, err := d.entry(index)
+			if err != nil {
+				return err
+			}
+			if err := emit(entry.name, entry.value); err != nil {
+				return err
+			}
+		case c&0xe0 == 0x20: // Dynamic table size update, only at the start of block
+			size, err := hpackReadInt(block, &pos, 5)
+			if err != nil || fieldSeen || size > uint64(d.allowedMaxSize) {
+				return errHpack
+			}
+			d.maxSize = int(size)
+			d.evict()
+		default: // Literal with incremental indexing (01), without indexing (0000) or never indexed (0001)
+			indexing := c&0xc0 == 0x40
+			n := uint(4)
+			if indexing {
+				n = 6
+			}
+			index, err := hpackReadInt(block, &pos, n)
+			if err != nil {
+				return err
+			}
+			var name []byte
+			if index != 0 {
+				entry, err := d.entry(index)
+				if err != nil {
+					return err
+				}
+				name = entry.name
+			} else {
+				if name, err = d.readString(block, &pos, 0); err != nil {
+					return err
+				}
+			}
+			value, err := d.readString(block, &pos, len(d.scratch))
+			if err != nil {
+				return err
+			}
+			if err := emit(name, value); err != nil {
+				return err
+			}
+			if indexing {
+				d.add(name, value)
+			}
+			d.scratch = d.scratch[:0]
+		}
+	}
+	return nil
+}
+
+// hpackAppendField appends field, indexed if found in static table, else as literal without indexing
+func hpackAppendField(dst []byte, name string, value string) []byte {
+	if index, ok := hpackStaticFields[hpackField{name, value}]; ok {
+		return hpackAppendInt(dst, 0x80, 7, uint64(index))
+	}
+	if index, ok := hpackStaticNames[name]; ok {
+		dst = hpackAppendInt(dst, 0x00, 4, uint64(index))
+	} else {
+		dst = append(dst, 0x00)
+		dst = hpackAppendInt(dst, 0x00, 7, uint64(len(name)))
+		dst = append(dst, name...)
+	}
+	dst = hpackAppendInt(dst, 0x00, 7, uint64(len(value)))
+	return append(dst, value...)
+}
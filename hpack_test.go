@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// hpackExample is header block from RFC 7541 Appendix C with fields and table size after decoding it
+type hpackExample struct {
+	block     string
+	fields    string // "name: value" lines
+	tableSize int
+}
+
+func hpackDecodeAll(t *testing.T, d *hpackDecoder, block []byte) (string, error) {
+	var fields []string
+	err := d.decode(block, func(name []byte, value []byte) error {
+		fields = append(fields, string(name)+": "+string(value))
+		return nil
+	})
+	return strings.Join(fields, "\n"), err
+}
+
+func testHpackExamples(t *testing.T, d hpackDecoder, examples []hpackExample) {
+	for i, ex := range examples {
+		block, err := hex.DecodeString(strings.ReplaceAll(ex.block, " ", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, err := hpackDecodeAll(t, &d, block)
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if fields != ex.fields || d.size != ex.tableSize {
+			t.Fatalf("block %d: got %q size %d, want %q size %d", i, fields, d.size, ex.fields, ex.tableSize)
+		}
+	}
+}
+
+var hpackRequestFields = []string{
+	":method: GET\n:scheme: http\n:path: /\n:authority: www.example.com",
+	":method: GET\n:scheme: http\n:path: /\n:authority: www.example.com\ncache-control: no-cache",
+	":method: GET\n:scheme: https\n:path: /index.html\n:authority: www.example.com\ncustom-key: custom-value",
+}
+
+var hpackResponseFields = []string{
+	":status: 302\ncache-control: private\ndate: Mon, 21 Oct 2013 20:13:21 GMT\nlocation: https://www.example.com",
+	":status: 307\ncache-control: private\ndate: Mon, 21 Oct 2013 20:13:21 GMT\nlocation: https://www.example.com",
+	":status: 200\ncache-control: private\ndate: Mon, 21 Oct 2013 20:13:22 GMT\nlocation: https://www.example.com\ncontent-encoding: gzip\nset-cookie: foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+}
+
+func TestHpackRequestExamples(t *testing.T) { // C.3
+	testHpackExamples(t, newHpackDecoder(), []hpackExample{
+		{"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", hpackRequestFields[0], 57},
+		{"8286 84be 5808 6e6f 2d63 6163 6865", hpackRequestFields[1], 110},
+		{"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", hpackRequestFields[2], 164},
+	})
+}
+
+func TestHpackRequestExamplesHuffman(t *testing.T) { // C.4
+	testHpackExamples(t, newHpackDecoder(), []hpackExample{
+		{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", hpackRequestFields[0], 57},
+		{"8286 84be 5886 a8eb 1064 9cbf", hpackRequestFields[1], 110},
+		{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", hpackRequestFields[2], 164},
+	})
+}
+
+func TestHpackResponseExamples(t *testing.T) { // C.5, table of 256 bytes, so entries are evicted
+	d := hpackDecoder{maxSize: 256, allowedMaxSize: 256}
+	testHpackExamples(t, d, []hpackExample{
+		{"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", hpackResponseFields[0], 222},
+		{"4803 3330 37c1 c0bf", hpackResponseFields[1], 222},
+		{"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31", hpackResponseFields[2], 215},
+	})
+}
+
+func TestHpackResponseExamplesHuffman(t *testing.T) { // C.6
+	d := hpackDecoder{maxSize: 256, allowedMaxSize: 256}
+	testHpackExamples(t, d, []hpackExample{
+		{"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3", hpackResponseFields[0], 222},
+		{"4883 640e ffc1 c0bf", hpackResponseFields[1], 222},
+		{"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07", hpackResponseFields[2], 215},
+	})
+}
+
+func TestHpackInteger(t *testing.T) { // C.1
+	for _, tc := range []struct {
+		value   uint64
+		n       uint
+		encoded string
+	}{{10, 5, "0a"}, {1337, 5, "1f9a0a"}, {42, 8, "2a"}} {
+		encoded := hex.EncodeToString(hpackAppendInt(nil, 0, tc.n, tc.value))
+		if encoded != tc.encoded {
+			t.Fatalf("%d: got %s, want %s", tc.value, encoded, tc.encoded)
+		}
+		b, _ := hex.DecodeString(encoded)
+		pos := 0
+		if value, err := hpackReadInt(b, &pos, tc.n); err != nil || value != tc.value || pos != len(b) {
+			t.Fatalf("%s: got %d %v", encoded, value, err)
+		}
+	}
+}
+
+func TestHpackTableSizeUpdate(t *testing.T) {
+	d := newHpackDecoder()
+	if _, err := hpackDecodeAll(t, &d, hpackAppendInt(nil, 0x20, 5, 4097)); err == nil { // Above SETTINGS_HEADER_TABLE_SIZE
+		t.Fatal("update above allowed size")
+	}
+	d = newHpackDecoder()
+	block := hpackAppendInt([]byte{0x20}, 0x20, 5, 2048) // Two updates at the start are allowed
+	if fields, err := hpackDecodeAll(t, &d, append(block, 0x82)); err != nil || fields != ":method: GET" || d.maxSize != 2048 {
+		t.Fatal(fields, err, d.maxSize)
+	}
+	// RFC 7541 section 4.2, update must be at the start of block
+	if _, err := hpackDecodeAll(t, &d, []byte{0x82, 0x20}); err != errHpack {
+		t.Fatal(err)
+	}
+}
+
+func TestHpackInvalidBlocks(t *testing.T) {
+	for _, block := range []string{
+		"80",         // Index 0
+		"be",         // Empty dynamic table
+		"4005 6162",  // String longer than block
+		"0081 ff",    // Huffman EOS prefix as padding longer than 7 bits
+		"0082 fe3f",  // Huffman EOS symbol
+		"ff80808080", // Integer not finished
+	} {
+		d := newHpackDecoder()
+		b, _ := hex.DecodeString(strings.ReplaceAll(block, " ", ""))
+		if _, err := hpackDecodeAll(t, &d, b); err == nil {
+			t.Errorf("%s: no error", block)
+		}
+	}
+}
+
+func TestHpackAppendFieldRoundTrip(t *testing.T) {
+	var block []byte
+	block = hpackAppendField(block, ":status", "200") // Static table field
+	block = hpackAppendField(block, "content-type", "text/html")
+	block = hpackAppendField(block, "x-custom", "value")
+	d := newHpackDecoder()
+	fields, err := hpackDecodeAll(t, &d, block)
+	if err != nil || fields != ":status: 200\ncontent-type: text/html\nx-custom: value" || len(d.dynamic) != 0 {
+		t.Fatal(fields, err, len(d.dynamic))
+	}
+}
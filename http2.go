@@ -0,0 +1,1097 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HTTP/2 over cleartext https://tools.ietf.org/html/rfc7540
+// Connection goroutine reads frames, each stream handler runs in its own goroutine.
+// Frames are written under writeMu into shared bufio.Writer, which is flushed when
+// reader has no more input, when stream ends or before waiting for flow control window.
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	H2_FRAME_DATA          = 0x0
+	H2_FRAME_HEADERS       = 0x1
+	H2_FRAME_PRIORITY      = 0x2
+	H2_FRAME_RST_STREAM    = 0x3
+	H2_FRAME_SETTINGS      = 0x4
+	H2_FRAME_PUSH_PROMISE  = 0x5
+	H2_FRAME_PING          = 0x6
+	H2_FRAME_GOAWAY        = 0x7
+	H2_FRAME_WINDOW_UPDATE = 0x8
+	H2_FRAME_CONTINUATION  = 0x9
+)
+
+const (
+	H2_FLAG_END_STREAM  = 0x1
+	H2_FLAG_ACK         = 0x1
+	H2_FLAG_END_HEADERS = 0x4
+	H2_FLAG_PADDED      = 0x8
+	H2_FLAG_PRIORITY    = 0x20
+)
+
+const (
+	H2_NO_ERROR           = 0x0
+	H2_PROTOCOL_ERROR     = 0x1
+	H2_INTERNAL_ERROR     = 0x2
+	H2_FLOW_CONTROL_ERROR = 0x3
+	H2_STREAM_CLOSED      = 0x5
+	H2_FRAME_SIZE_ERROR   = 0x6
+	H2_REFUSED_STREAM     = 0x7
+	H2_CANCEL             = 0x8
+	H2_COMPRESSION_ERROR  = 0x9
+)
+
+const (
+	H2_SETTINGS_HEADER_TABLE_SIZE      = 0x1
+	H2_SETTINGS_ENABLE_PUSH            = 0x2
+	H2_SETTINGS_MAX_CONCURRENT_STREAMS = 0x3
+	H2_SETTINGS_INITIAL_WINDOW_SIZE    = 0x4
+	H2_SETTINGS_MAX_FRAME_SIZE         = 0x5
+	H2_SETTINGS_MAX_HEADER_LIST_SIZE   = 0x6
+)
+
+const h2FrameHeaderSize = 9
+const h2MaxFrameSize = 16384 // We never raise default SETTINGS_MAX_FRAME_SIZE
+const h2DefaultWindow = 65535
+const h2MaxWindow = 1<<31 - 1
+const h2MaxStreams = 100
+const h2MaxHeaderBlockSize = 64 * 1024
+const h2MaxHeaderListSize = 64 * 1024 // Decoded, name + value + 32 per field. Indexed fields make it much larger than block.
+const h2WriteBufferSize = 32 * 1024
+
+var errHTTP2Preface = errors.New("HTTP/2 connection preface")
+var errH2StreamReset = errors.New("HTTP/2 stream reset")
+var errH2ConnClosed = errors.New("HTTP/2 connection closed")
+var errH2Hijack = errors.New("Hijack is not supported for HTTP/2 streams")
+
+// h2ConnError is error code of GOAWAY we send before closing connection
+type h2ConnError uint32
+
+func (e h2ConnError) Error() string {
+	return "HTTP/2 connection error " + strconv.Itoa(int(e))
+}
+
+type h2Conn struct {
+	c      *Client
+	reader *bufio.Reader
+
+	// Reader state, only connection goroutine
+	frameHeader     [h2FrameHeaderSize]byte
+	payload         []byte
+	headerBlock     []byte
+	headerStream    uint32 // Waiting for CONTINUATION of this stream, 0 if none
+	headerEndStream bool
+	decoder         hpackDecoder
+
+	writeMu     sync.Mutex
+	writer      *bufio.Writer
+	writeHeader [h2FrameHeaderSize]byte
+	writeErr    error  // Sticky
+	headerBuf   []byte // Encoded response header block
+
+	mu                sync.Mutex
+	cond              sync.Cond // Broadcast on any change of stream data or windows
+	streams           map[uint32]*h2Stream
+	lastStreamID      uint32
+	sendWindow        int64
+	recvWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  int
+	closed            bool
+
+	handlers sync.WaitGroup
+}
+
+type h2Stream struct {
+	sc     *h2Conn
+	id     uint32
+	parser Client // Its request is given to handler, header parsing is reused
+	arena  []byte // Request bytes, decoded header fields are valid only during decode
+	cancel context.CancelFunc
+
+	malformed      bool
+	regularHeader  bool // Pseudo headers are not allowed after regular ones
+	hasScheme      bool
+	headerListSize int
+
+	// Guarded by sc.mu
+	sendWindow   int64
+	recvWindow   int64
+	data         []byte // Received, not yet read by handler
+	dataErr      error  // Returned after data, io.EOF after END_STREAM
+	remoteClosed bool
+	reset        bool
+
+	bodyReader h2Body
+
+	// Response state, only handler goroutine
+	status        int
+	headers       []hpackField
+	headersSent   bool
+	dateWritten   bool
+	serverWritten bool
+	contentLength int64
+	bytesWritten  int64
+}
+
+type h2Body struct {
+	st *h2Stream
+}
+
+// h2cUpgradeSettings returns decoded http2-settings if request asks to switch to h2c
+func (c *Client) h2cUpgradeSettings() ([]byte, bool) {
+	r := &c.request
+	if !r.WantsUpgrade("h2c") || r.VersionMinor < 1 || c.body.err != io.EOF {
+		return nil, false // Requests with body are served by HTTP/1.1, as allowed by RFC
+	}
+	var value []byte
+	found := 0
+	for _, kv := range r.HopByHopHeaders {
+		if string(kv.key) == "http2-settings" {
+			value = kv.value
+			found++
+		}
+	}
+	if found != 1 {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(string(value), "="))
+	if err != nil || len(settings)%6 != 0 {
+		return nil, false
+	}
+	return settings, true
+}
+
+// serveHTTP2 takes over connection after preface was detected or upgrade requested.
+// When upgrading, c.request becomes stream 1.
+func (c *Client) serveHTTP2(upgradeSettings []byte, upgrade bool) {
+	if upgrade {
+		c.writeString("HTTP/1.1 101 Switching Protocols\r\nconnection: Upgrade\r\nupgrade: h2c\r\n\r\n")
+		if err := c.flush(); err != nil {
+			c.close()
+			return
+		}
+	}
+	leftover := append([]byte{}, c.incomingBuffer[c.incomingReadPos:c.incomingWritePos]...)
+	c.incomingReadPos = 0
+	c.incomingWritePos = 0
+	sc := &h2Conn{
+		c:                 c,
+		reader:            bufio.NewReaderSize(io.MultiReader(bytes.NewReader(leftover), c.incomingReader), h2MaxFrameSize+h2FrameHeaderSize),
+		payload:           make([]byte, h2MaxFrameSize),
+		decoder:           newHpackDecoder(),
+		writer:            bufio.NewWriterSize(c.conn, h2WriteBufferSize),
+		streams:           map[uint32]*h2Stream{},
+		sendWindow:        h2DefaultWindow,
+		recvWindow:        h2DefaultWindow,
+		peerInitialWindow: h2DefaultWindow,
+		peerMaxFrameSize:  h2MaxFrameSize,
+	}
+	sc.cond.L = &sc.mu
+	sc.serve(upgradeSettings, upgrade)
+}
+
+func (sc *h2Conn) serve(upgradeSettings []byte, upgrade bool) {
+	var settings [12]byte
+	binary.BigEndian.PutUint16(settings[0:], H2_SETTINGS_MAX_CONCURRENT_STREAMS)
+	binary.BigEndian.PutUint32(settings[2:], h2MaxStreams)
+	binary.BigEndian.PutUint16(settings[6:], H2_SETTINGS_MAX_HEADER_LIST_SIZE)
+	binary.BigEndian.PutUint32(settings[8:], h2MaxHeaderListSize)
+	sc.writeFrame(H2_FRAME_SETTINGS, 0, 0, settings[:])
+	err := sc.flush()
+	if err == nil && upgrade { // Settings from header are acknowledged implicitly
+		if err = sc.applySettings(upgradeSettings); err == nil {
+			st := sc.newStream(1)
+			st.copyRequest(&sc.c.request)
+			sc.lastStreamID = 1
+			sc.startStream(st, true)
+		}
+	}
+	if err == nil {
+		var preface [len(h2Preface)]byte
+		if _, err = io.ReadFull(sc.reader, preface[:]); err == nil && string(preface[:]) != h2Preface {
+			err = h2ConnError(H2_PROTOCOL_ERROR)
+		}
+	}
+	if err == nil {
+		sc.c.setState(StateActive) // Streams come and go, so connection is not reported idle
+		err = sc.readLoop()
+	}
+	if code, ok := err.(h2ConnError); ok {
+		sc.mu.Lock()
+		lastStreamID := sc.lastStreamID
+		sc.mu.Unlock()
+		var goAway [8]byte
+		binary.BigEndian.PutUint32(goAway[0:], lastStreamID)
+		binary.BigEndian.PutUint32(goAway[4:], uint32(code))
+		sc.writeFrame(H2_FRAME_GOAWAY, 0, 0, goAway[:])
+		_ = sc.flush()
+	}
+	sc.shutdown()
+}
+
+// shutdown aborts streams, closes connection and waits for handlers
+func (sc *h2Conn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		if st.dataErr == nil {
+			st.dataErr = errH2ConnClosed
+		}
+		st.cancel()
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	_ = sc.c.conn.Close()
+	sc.handlers.Wait()
+	sc.c.setState(StateClosed)
+}
+
+func (sc *h2Conn) readFrame() (typ byte, flags byte, streamID uint32, payload []byte, err error) {
+	if _, err = io.ReadFull(sc.reader, sc.frameHeader[:]); err != nil {
+		return
+	}
+	h := sc.frameHeader[:]
+	length := int(h[0])<<16 | int(h[1])<<8 | int(h[2])
+	typ = h[3]
+	flags = h[4]
+	streamID = binary.BigEndian.Uint32(h[5:]) & 0x7fffffff
+	if length > len(sc.payload) {
+		err = h2ConnError(H2_FRAME_SIZE_ERROR)
+		return
+	}
+	payload = sc.payload[:length]
+	_, err = io.ReadFull(sc.reader, payload)
+	return
+}
+
+func (sc *h2Conn) readLoop() error {
+	for {
+		typ, flags, streamID, payload, err := sc.readFrame()
+		if err != nil {
+			return err
+		}
+		if sc.headerStream != 0 && (typ != H2_FRAME_CONTINUATION || streamID != sc.headerStream) {
+			return h2ConnError(H2_PROTOCOL_ERROR)
+		}
+		switch typ {
+		case H2_FRAME_DATA:
+			err = sc.processData(flags, streamID, payload)
+		case H2_FRAME_HEADERS:
+			err = sc.processHeaders(flags, streamID, payload)
+		case H2_FRAME_CONTINUATION:
+			err = sc.processContinuation(flags, streamID, payload)
+		case H2_FRAME_PRIORITY: // Ignored, streams are served concurrently anyway
+			if streamID == 0 {
+				err = h2ConnError(H2_PROTOCOL_ERROR)
+			} else if len(payload) != 5 {
+				err = h2ConnError(H2_FRAME_SIZE_ERROR)
+			}
+		case H2_FRAME_RST_STREAM:
+			err = sc.processRSTStream(streamID, payload)
+		case H2_FRAME_SETTINGS:
+			err = sc.processSettings(flags, streamID, payload)
+		case H2_FRAME_PUSH_PROMISE: // Only servers push
+			err = h2ConnError(H2_PROTOCOL_ERROR)
+		case H2_FRAME_PING:
+			if streamID != 0 {
+				err = h2ConnError(H2_PROTOCOL_ERROR)
+			} else if len(payload) != 8 {
+				err = h2ConnError(H2_FRAME_SIZE_ERROR)
+			} else if flags&H2_FLAG_ACK == 0 {
+				sc.writeFrame(H2_FRAME_PING, H2_FLAG_ACK, 0, payload)
+			}
+		case H2_FRAME_GOAWAY: // Peer will close connection after responses to started streams
+			if streamID != 0 {
+				err = h2ConnError(H2_PROTOCOL_ERROR)
+			}
+		case H2_FRAME_WINDOW_UPDATE:
+			err = sc.processWindowUpdate(streamID, payload)
+		default: // Unknown frame types must be ignored
+		}
+		if err != nil {
+			return err
+		}
+		if sc.reader.Buffered() == 0 { // Batch our control frames
+			if err := sc.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// h2StripPadding returns payload without pad length and padding
+func h2StripPadding(flags byte, payload []byte) ([]byte, error) {
+	if flags&H2_FLAG_PADDED == 0 {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, h2ConnError(H2_FRAME_SIZE_ERROR)
+	}
+	padLength := int(payload[0])
+	if padLength >= len(payload) {
+		return nil, h2ConnError(H2_PROTOCOL_ERROR)
+	}
+	return payload[1 : len(payload)-padLength], nil
+}
+
+func (sc *h2Conn) processHeaders(flags byte, streamID uint32, payload []byte) error {
+	if streamID == 0 || streamID%2 == 0 {
+		return h2ConnError(H2_PROTOCOL_ERROR)
+	}
+	payload, err := h2StripPadding(flags, payload)
+	if err != nil {
+		return err
+	}
+	if flags&H2_FLAG_PRIORITY != 0 {
+		if len(payload) < 5 {
+			return h2ConnError(H2_FRAME_SIZE_ERROR)
+		}
+		payload = payload[5:]
+	}
+	sc.headerBlock = append(sc.headerBlock[:0], payload...)
+	sc.headerStream = streamID
+	sc.headerEndStream = flags&H2_FLAG_END_STREAM != 0
+	if flags&H2_FLAG_END_HEADERS != 0 {
+		return sc.processHeaderBlock()
+	}
+	return nil
+}
+
+func (sc *h2Conn) processContinuation(flags byte, streamID uint32, payload []byte) error {
+	if sc.headerStream == 0 || streamID != sc.headerStream {
+		return h2ConnError(H2_PROTOCOL_ERROR)
+	}
+	if len(sc.headerBlock)+len(payload) > h2MaxHeaderBlockSize {
+		return h2ConnError(H2_PROTOCOL_ERROR)
+	}
+	sc.headerBlock = append(sc.headerBlock, payload...)
+	if flags&H2_FLAG_END_HEADERS != 0 {
+		return sc.processHeaderBlock()
+	}
+	return nil
+}
+
+func (sc *h2Conn) processHeaderBlock() error {
+	streamID := sc.headerStream
+	endStream := sc.headerEndStream
+	sc.headerStream = 0
+	sc.mu.Lock()
+	existing, found := sc.streams[streamID]
+	isNew := streamID > sc.lastStreamID
+	if isNew {
+		sc.lastStreamID = streamID
+	}
+	active := len(sc.streams)
+	sc.mu.Unlock()
+	if !isNew { // Trailers, or headers of stream we already finished. Decoded only to keep HPACK state.
+		if err := sc.decoder.decode(sc.headerBlock, func([]byte, []byte) error { return nil }); err != nil {
+			return h2ConnError(H2_COMPRESSION_ERROR)
+		}
+		if !found {
+			return nil
+		}
+		if !endStream {
+			sc.resetStream(streamID, H2_PROTOCOL_ERROR)
+			return nil
+		}
+		sc.mu.Lock()
+		if !existing.remoteClosed {
+			existing.remoteClosed = true
+			existing.dataErr = io.EOF
+			sc.cond.Broadcast()
+		}
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.c.requestNum++
+	st := sc.newStream(streamID)
+	if err := sc.decoder.decode(sc.headerBlock, st.addField); err != nil {
+		return h2ConnError(H2_COMPRESSION_ERROR)
+	}
+	if !st.validRequest() {
+		sc.resetStream(streamID, H2_PROTOCOL_ERROR)
+		return nil
+	}
+	if active >= h2MaxStreams {
+		sc.resetStream(streamID, H2_REFUSED_STREAM)
+		return nil
+	}
+	sc.startStream(st, endStream)
+	return nil
+}
+
+func (sc *h2Conn) processData(flags byte, streamID uint32, payload []byte) error {
+	if streamID == 0 {
+		return h2ConnError(H2_PROTOCOL_ERROR)
+	}
+	size := int64(len(payload)) // Padding counts for flow control
+	data, err := h2StripPadding(flags, payload)
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	if size > sc.recvWindow {
+		sc.mu.Unlock()
+		return h2ConnError(H2_FLOW_CONTROL_ERROR)
+	}
+	st := sc.streams[streamID]
+	if streamID > sc.lastStreamID {
+		sc.mu.Unlock()
+		return h2ConnError(H2_PROTOCOL_ERROR) // Idle stream
+	}
+	if st == nil || st.remoteClosed || st.reset || size > st.recvWindow {
+		sc.mu.Unlock()
+		sc.writeWindowUpdate(0, size) // Data is dropped, so peer may send as much again
+		if st != nil && !st.reset {
+			code := uint32(H2_STREAM_CLOSED)
+			if !st.remoteClosed {
+				code = H2_FLOW_CONTROL_ERROR
+			}
+			sc.resetStream(streamID, code)
+		}
+		return nil
+	}
+	st.data = append(st.data, data...)
+	padding := size - int64(len(data))
+	sc.recvWindow -= size - padding // Padding is credited back at once
+	st.recvWindow -= size - padding
+	if flags&H2_FLAG_END_STREAM != 0 {
+		st.remoteClosed = true
+		st.dataErr = io.EOF
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	if padding != 0 {
+		sc.writeWindowUpdate(0, padding)
+		sc.writeWindowUpdate(streamID, padding)
+	}
+	return nil
+}
+
+func (sc *h2Conn) processRSTStream(streamID uint32, payload []byte) error {
+	if streamID == 0 {
+		return h2ConnError(H2_PROTOCOL_ERROR)
+	}
+	if len(payload) != 4 {
+		return h2ConnError(H2_FRAME_SIZE_ERROR)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if streamID > sc.lastStreamID {
+		return h2ConnError(H2_PROTOCOL_ERROR) // Idle stream
+	}
+	if st := sc.streams[streamID]; st != nil {
+		st.abortLocked()
+	}
+	return nil
+}
+
+func (sc *h2Conn) processSettings(flags byte, streamID uint32, payload []byte) error {
+	if streamID != 0 {
+		return h2ConnError(H2_PROTOCOL_ERROR)
+	}
+	if flags&H2_FLAG_ACK != 0 {
+		if len(payload) != 0 {
+			return h2ConnError(H2_FRAME_SIZE_ERROR)
+		}
+		return nil
+	}
+	if len(payload)%6 != 0 {
+		return h2ConnError(H2_FRAME_SIZE_ERROR)
+	}
+	if err := sc.applySettings(payload); err != nil {
+		return err
+	}
+	sc.writeFrame(H2_FRAME_SETTINGS, H2_FLAG_ACK, 0, nil)
+	return nil
+}
+
+func (sc *h2Conn) applySettings(payload []byte) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for ; len(payload) >= 6; payload = payload[6:] {
+		value := binary.BigEndian.Uint32(payload[2:])
+		switch binary.BigEndian.Uint16(payload) {
+		case H2_SETTINGS_ENABLE_PUSH:
+			if value > 1 {
+				return h2ConnError(H2_PROTOCOL_ERROR)
+			}
+		case H2_SETTINGS_INITIAL_WINDOW_SIZE:
+			if value > h2MaxWindow {
+				return h2ConnError(H2_FLOW_CONTROL_ERROR)
+			}
+			delta := int64(value) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(value)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > h2MaxWindow {
+					return h2ConnError(H2_FLOW_CONTROL_ERROR)
+				}
+			}
+			sc.cond.Broadcast()
+		case H2_SETTINGS_MAX_FRAME_SIZE:
+			if value < h2MaxFrameSize || value > 1<<24-1 {
+				return h2ConnError(H2_PROTOCOL_ERROR)
+			}
+			sc.peerMaxFrameSize = int(value)
+		default: // Our encoder does not use dynamic table, so header table size is ignored too
+		}
+	}
+	return nil
+}
+
+func (sc *h2Conn) processWindowUpdate(streamID uint32, payload []byte) error {
+	if len(payload) != 4 {
+		return h2ConnError(H2_FRAME_SIZE_ERROR)
+	}
+	increment := int64(binary.BigEndian.Uint32(payload) & 0x7fffffff)
+	if streamID == 0 {
+		if increment == 0 {
+			return h2ConnError(H2_PROTOCOL_ERROR)
+		}
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		sc.sendWindow += increment
+		if sc.sendWindow > h2MaxWindow {
+			return h2ConnError(H2_FLOW_CONTROL_ERROR)
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	sc.mu.Lock()
+	st := sc.streams[streamID]
+	code := uint32(H2_NO_ERROR)
+	if st != nil && !st.reset {
+		st.sendWindow += increment
+		if increment == 0 {
+			code = H2_PROTOCOL_ERROR
+		} else if st.sendWindow > h2MaxWindow {
+			code = H2_FLOW_CONTROL_ERROR
+		}
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+	if code != H2_NO_ERROR {
+		sc.resetStream(streamID, code)
+	}
+	return nil
+}
+
+// resetStream sends RST_STREAM and aborts stream if it is running
+func (sc *h2Conn) resetStream(streamID uint32, code uint32) {
+	sc.mu.Lock()
+	if st := sc.streams[streamID]; st != nil {
+		st.abortLocked()
+	}
+	sc.mu.Unlock()
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], code)
+	sc.writeFrame(H2_FRAME_RST_STREAM, 0, streamID, payload[:])
+}
+
+func (sc *h2Conn) writeFrame(typ byte, flags byte, streamID uint32, payload []byte) {
+	sc.writeMu.Lock()
+	sc.writeFrameLocked(typ, flags, streamID, payload)
+	sc.writeMu.Unlock()
+}
+
+func (sc *h2Conn) writeFrameLocked(typ byte, flags byte, streamID uint32, payload []byte) {
+	if sc.writeErr != nil {
+		return
+	}
+	h := sc.writeHeader[:]
+	h[0] = byte(len(payload) >> 16)
+	h[1] = byte(len(payload) >> 8)
+	h[2] = byte(len(payload))
+	h[3] = typ
+	h[4] = flags
+	binary.BigEndian.PutUint32(h[5:], streamID)
+	if _, sc.writeErr = sc.writer.Write(h); sc.writeErr == nil {
+		_, sc.writeErr = sc.writer.Write(payload)
+	}
+}
+
+func (sc *h2Conn) writeWindowUpdate(streamID uint32, increment int64) {
+	if increment <= 0 {
+		return
+	}
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(increment))
+	sc.writeFrame(H2_FRAME_WINDOW_UPDATE, 0, streamID, payload[:])
+}
+
+func (sc *h2Conn) flush() error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	if sc.writeErr == nil {
+		sc.writeErr = sc.writer.Flush()
+	}
+	return sc.writeErr
+}
+
+func (sc *h2Conn) newStream(streamID uint32) *h2Stream {
+	st := &h2Stream{sc: sc, id: streamID, contentLength: -1, recvWindow: h2DefaultWindow}
+	st.bodyReader.st = st
+	st.parser.server = sc.c.server // For header IDs registered on server
+	r := &st.parser.request
+	r.ContentLength = -1
+	r.VersionMajor = 2
+	r.KeepAlive = true
+	r.RemoteAddr = sc.c.request.RemoteAddr
+	r.TLS = sc.c.request.TLS
+	r.PeerCertificates = sc.c.request.PeerCertificates
+	r.body = &st.bodyReader
+	r.client = sc.c                // For ConnInfo and ClientIP, Context is set by startStream
+	r.requestNum = sc.c.requestNum // Stream 1 of upgrade is the request which was counted already
+	return st
+}
+
+// startStream registers stream and runs handler
+func (sc *h2Conn) startStream(st *h2Stream, endStream bool) {
+	s := sc.c.server
+	if s.RequestTimeout > 0 {
+		st.parser.request.ctx, st.cancel = context.WithTimeout(s.baseContext(), s.RequestTimeout)
+	} else {
+		st.parser.request.ctx, st.cancel = context.WithCancel(s.baseContext())
+	}
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	if endStream {
+		st.remoteClosed = true
+		st.dataErr = io.EOF
+	}
+	sc.streams[st.id] = st
+	sc.mu.Unlock()
+	sc.handlers.Add(1)
+	go st.run()
+}
+
+func (st *h2Stream) arenaCopy(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	start := len(st.arena)
+	st.arena = append(st.arena, b...) // Earlier slices keep old array if reallocated
+	return st.arena[start:len(st.arena):len(st.arena)]
+}
+
+// copyRequest copies HTTP/1.1 request which is upgraded to stream 1
+func (st *h2Stream) copyRequest(src *Request) {
+	r := &st.parser.request
+	r.Method = st.arenaCopy(src.Method)
+	r.Path = st.arenaCopy(src.Path)
+	r.QueryString = st.arenaCopy(src.QueryString)
+	r.RawTarget = st.arenaCopy(src.RawTarget)
+	r.Host = st.arenaCopy(src.Host)
+	r.Origin = st.arenaCopy(src.Origin)
+	r.ContentTypeMime = st.arenaCopy(src.ContentTypeMime)
+	r.ContentTypeSuffix = st.arenaCopy(src.ContentTypeSuffix)
+	r.BasicAuthorization = st.arenaCopy(src.BasicAuthorization)
+	r.ContentLength = src.ContentLength
+	for _, kv := range src.Headers {
+		r.Headers = append(r.Headers, HeaderKV{id: kv.id, key: st.arenaCopy(kv.key), value: st.arenaCopy(kv.value)})
+	}
+	r.headerTable = src.headerTable
+}
+
+// h2ConnectionSpecific tells if header is not allowed in HTTP/2
+func h2ConnectionSpecific(key string) bool {
+	return key == "connection" || key == "keep-alive" || key == "proxy-connection" || key == "transfer-encoding" || key == "upgrade"
+}
+
+// addField is called by decoder, malformed request is reset after the whole block is decoded
+func (st *h2Stream) addField(name []byte, value []byte) error {
+	if st.malformed {
+		return nil
+	}
+	st.headerListSize += len(name) + len(value) + hpackEntryOverhead
+	if st.headerListSize > h2MaxHeaderListSize { // Stop copying to arena, stream is reset
+		st.malformed = true
+		return nil
+	}
+	for _, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			st.malformed = true
+			return nil
+		}
+	}
+	r := &st.parser.request
+	if len(name) != 0 && name[0] == ':' {
+		if st.regularHeader {
+			st.malformed = true
+			return nil
+		}
+		switch string(name) {
+		case ":method":
+			st.malformed = st.malformed || r.Method != nil
+			r.Method = st.arenaCopy(value)
+		case ":scheme":
+			st.malformed = st.malformed || st.hasScheme
+			st.hasScheme = true
+		case ":authority":
+			r.Host = st.arenaCopy(value)
+		case ":path":
+			if r.Path != nil || len(value) == 0 {
+				st.malformed = true
+				return nil
+			}
+			start := len(st.arena)
+			st.arena = append(st.arena, value...)
+			st.arena = append(st.arena, "   "...) // Sentinels for URI parser, which stops at space
+			pos := 0
+			if !st.parser.parseURI(st.arena[start:], &pos) || pos != len(value) {
+				st.malformed = true
+			}
+		default:
+			st.malformed = true
+		}
+		return nil
+	}
+	st.regularHeader = true
+	if h2ConnectionSpecific(string(name)) || string(name) == "te" && string(value) != "trailers" {
+		st.malformed = true
+		return nil
+	}
+	st.parser.headerCMSList = false
+	if !st.parser.processReadyHeader(st.arenaCopy(name), st.arenaCopy(value)) {
+		st.malformed = true
+	}
+	return nil
+}
+
+func (st *h2Stream) validRequest() bool {
+	r := &st.parser.request
+	if st.malformed || r.Method == nil {
+		return false
+	}
+	if string(r.Method) == "CONNECT" {
+		return r.Host != nil && r.Path == nil && !st.hasScheme
+	}
+	return r.Path != nil && st.hasScheme
+}
+
+// abortLocked is called under sc.mu when stream is reset by either side
+func (st *h2Stream) abortLocked() {
+	st.reset = true
+	st.data = st.data[:0]
+	st.dataErr = errH2StreamReset
+	st.cancel()
+	st.sc.cond.Broadcast()
+}
+
+func (st *h2Stream) run() {
+	defer st.sc.handlers.Done()
+	if st.callHandler() {
+		st.finishResponse()
+	} else {
+		st.abortResponse()
+	}
+	st.close()
+}
+
+// callHandler returns false if handler panicked
+func (st *h2Stream) callHandler() (ok bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			ok = false
+			st.sc.c.server.reportPanic(&st.parser.request, recovered)
+		}
+	}()
+	st.sc.c.server.handler(st, &st.parser.request)
+	return true
+}
+
+func (st *h2Stream) finishResponse() {
+	if st.contentLength >= 0 && st.bytesWritten != st.contentLength && string(st.parser.request.Method) != "HEAD" {
+		st.abortResponse()
+		return
+	}
+	if !st.headersSent {
+		_ = st.writeHeaders(true)
+		return
+	}
+	_ = st.writeData(nil, true)
+}
+
+// abortResponse sends 500 if nothing was sent yet, otherwise resets stream
+func (st *h2Stream) abortResponse() {
+	if !st.headersSent {
+		st.status = 500
+		st.headers = st.headers[:0]
+		st.contentLength = -1
+		_ = st.writeHeaders(true)
+		return
+	}
+	st.sc.resetStream(st.id, H2_INTERNAL_ERROR)
+}
+
+// close removes finished stream, credits unread body back to connection window
+func (st *h2Stream) close() {
+	sc := st.sc
+	sc.mu.Lock()
+	delete(sc.streams, st.id)
+	unread := int64(len(st.data))
+	sc.recvWindow += unread
+	sendReset := !st.remoteClosed && !st.reset // Response is complete, we do not need the rest of request
+	st.reset = true
+	st.data = nil
+	sc.mu.Unlock()
+	st.cancel()
+	if sendReset {
+		var payload [4]byte // H2_NO_ERROR
+		sc.writeFrame(H2_FRAME_RST_STREAM, 0, st.id, payload[:])
+	}
+	sc.writeWindowUpdate(0, unread)
+	_ = sc.flush()
+}
+
+func (b *h2Body) Read(p []byte) (int, error) {
+	st := b.st
+	sc := st.sc
+	sc.mu.Lock()
+	for len(st.data) == 0 && st.dataErr == nil {
+		sc.cond.Wait()
+	}
+	if len(st.data) == 0 {
+		err := st.dataErr
+		sc.mu.Unlock()
+		return 0, err
+	}
+	n := copy(p, st.data)
+	st.data = st.data[:copy(st.data, st.data[n:])]
+	sc.recvWindow += int64(n)
+	st.recvWindow += int64(n)
+	remoteClosed := st.remoteClosed
+	sc.mu.Unlock()
+	sc.writeWindowUpdate(0, int64(n))
+	if !remoteClosed {
+		sc.writeWindowUpdate(st.id, int64(n))
+	}
+	return n, sc.flush()
+}
+
+// reserveWindow waits for send window and takes up to size bytes of it
+func (st *h2Stream) reserveWindow(size int) (int, error) {
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	flushed := false
+	for {
+		if st.reset {
+			return 0, errH2StreamReset
+		}
+		if sc.closed {
+			return 0, errH2ConnClosed
+		}
+		n := int64(size)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > sc.sendWindow {
+			n = sc.sendWindow
+		}
+		if n > int64(sc.peerMaxFrameSize) {
+			n = int64(sc.peerMaxFrameSize)
+		}
+		if n > 0 {
+			st.sendWindow -= n
+			sc.sendWindow -= n
+			return int(n), nil
+		}
+		if !flushed { // Peer must see our data to send WINDOW_UPDATE
+			sc.mu.Unlock()
+			err := sc.flush()
+			sc.mu.Lock()
+			if err != nil {
+				return 0, err
+			}
+			flushed = true
+			continue
+		}
+		sc.cond.Wait()
+		flushed = false
+	}
+}
+
+func (st *h2Stream) writeHeaders(endStream bool) error {
+	sc := st.sc
+	st.headersSent = true
+	if st.status == 0 {
+		st.status = 200
+	}
+	sc.mu.Lock()
+	maxFrameSize := sc.peerMaxFrameSize
+	reset := st.reset || sc.closed
+	sc.mu.Unlock()
+	if reset {
+		return errH2StreamReset
+	}
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	block := hpackAppendField(sc.headerBuf[:0], ":status", strconv.Itoa(st.status))
+	if !st.serverWritten {
+		block = hpackAppendField(block, "server", "crab")
+	}
+	if !st.dateWritten {
+		block = hpackAppendField(block, "date", string(sc.c.server.dateBuffer()))
+	}
+	for _, h := range st.headers {
+		block = hpackAppendField(block, h.name, h.value)
+	}
+	sc.headerBuf = block
+	typ := byte(H2_FRAME_HEADERS)
+	flags := byte(0)
+	if endStream {
+		flags = H2_FLAG_END_STREAM
+	}
+	for {
+		fragment := block
+		if len(fragment) > maxFrameSize {
+			fragment = fragment[:maxFrameSize]
+		}
+		block = block[len(fragment):]
+		if len(block) == 0 {
+			flags |= H2_FLAG_END_HEADERS
+		}
+		sc.writeFrameLocked(typ, flags, st.id, fragment)
+		if len(block) == 0 {
+			return sc.writeErr
+		}
+		typ = H2_FRAME_CONTINUATION
+		flags = 0
+	}
+}
+
+// writeData sends data respecting flow control, with END_STREAM on the last frame if endStream
+func (st *h2Stream) writeData(data []byte, endStream bool) error {
+	sc := st.sc
+	for {
+		n := 0
+		if len(data) != 0 {
+			var err error
+			if n, err = st.reserveWindow(len(data)); err != nil {
+				return err
+			}
+		}
+		flags := byte(0)
+		if endStream && n == len(data) {
+			flags = H2_FLAG_END_STREAM
+		}
+		sc.writeMu.Lock()
+		sc.writeFrameLocked(H2_FRAME_DATA, flags, st.id, data[:n])
+		err := sc.writeErr
+		sc.writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// WriteStatus sets status of response. Informational statuses are not supported and ignored.
+func (st *h2Stream) WriteStatus(statusCode int) {
+	if st.headersSent || st.status != 0 || statusCode < 200 {
+		return
+	}
+	st.status = statusCode
+}
+
+func (st *h2Stream) WriteDate(date string) {
+	if st.headersSent || st.dateWritten {
+		return
+	}
+	st.dateWritten = true
+	st.headers = append(st.headers, hpackField{"date", date})
+}
+
+func (st *h2Stream) WriteServer(server string) {
+	if st.headersSent || st.serverWritten {
+		return
+	}
+	st.serverWritten = true
+	st.headers = append(st.headers, hpackField{"server", server})
+}
+
+func (st *h2Stream) WriteContentLength(length int64) {
+	if st.headersSent || length < 0 || st.contentLength >= 0 {
+		return
+	}
+	st.contentLength = length
+	st.headers = append(st.headers, hpackField{"content-length", strconv.FormatInt(length, 10)})
+}
+
+// WriteOtherHeader lowercases key, as HTTP/2 requires. Connection-specific headers are dropped.
+func (st *h2Stream) WriteOtherHeader(key string, value string) {
+	if st.headersSent {
+		return
+	}
+	key = strings.ToLower(key)
+	if h2ConnectionSpecific(key) {
+		return
+	}
+	st.headers = append(st.headers, hpackField{key, value})
+}
+
+func (st *h2Stream) WriteSetCookie(cookie *Cookie) error {
+	if err := cookie.validate(); err != nil {
+		return err
+	}
+	if st.headersSent {
+		return errHeadersWritten
+	}
+	st.headers = append(st.headers, hpackField{"set-cookie", string(appendCookie(nil, cookie))})
+	return nil
+}
+
+func (st *h2Stream) Write(data []byte) (int, error) {
+	if !st.headersSent {
+		if err := st.writeHeaders(false); err != nil {
+			return 0, err
+		}
+	}
+	if st.contentLength >= 0 && st.bytesWritten+int64(len(data)) > st.contentLength {
+		return 0, errors.New("Body overflow")
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if string(st.parser.request.Method) == "HEAD" { // Counted but not sent, like in Client.Write
+		st.bytesWritten += int64(len(data))
+		return len(data), nil
+	}
+	if err := st.writeData(data, false); err != nil {
+		return 0, err
+	}
+	st.bytesWritten += int64(len(data))
+	return len(data), nil
+}
+
+func (st *h2Stream) Flush() error {
+	if !st.headersSent {
+		if err := st.writeHeaders(false); err != nil {
+			return err
+		}
+	}
+	return st.sc.flush()
+}
+
+func (st *h2Stream) Hijack() (net.Conn, []byte, []byte, error) {
+	return nil, nil, nil, errH2Hijack
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func h2Handler(wr ResponseWriter, r *Request) {
+	body, _ := io.ReadAll(r.Body())
+	switch string(r.Path) {
+	case "/big":
+		wr.WriteOtherHeader("x-big", "yes")
+		_, _ = wr.Write(bytes.Repeat([]byte("x"), 300000))
+		return
+	case "/panic":
+		panic(http.ErrAbortHandler)
+	}
+	wr.WriteOtherHeader("x-method", string(r.Method))
+	_, _ = fmt.Fprintf(wr, "%s %s %s v%d len=%d hdr=%s", r.Method, r.Path, r.QueryString, r.VersionMajor, len(body), r.HeaderLower("x-custom"))
+}
+
+func h2cClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: &protocols}, Timeout: 10 * time.Second}
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	addr := startServer(t, &Server{handler: h2Handler, H2C: true})
+	client := h2cClient()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ { // Concurrent streams with bodies larger than flow control windows
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", fmt.Sprintf("http://%s/p%%20ath/%d?q=%d", addr, i, i), bytes.NewReader(bytes.Repeat([]byte("y"), 200000)))
+			req.Header.Set("X-Custom", strings.Repeat("v", i))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			want := fmt.Sprintf("POST /p ath/%d q=%d v2 len=200000 hdr=%s", i, i, strings.Repeat("v", i))
+			if resp.ProtoMajor != 2 || string(b) != want || resp.Header.Get("x-method") != "POST" {
+				t.Errorf("got %d %q %v, want %q", resp.ProtoMajor, b, resp.Header, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	resp, err := client.Get("http://" + addr + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if len(b) != 300000 || resp.Header.Get("x-big") != "yes" {
+		t.Fatal(len(b), resp.Header)
+	}
+	if resp, err = client.Get("http://" + addr + "/panic"); err != nil || resp.StatusCode != 500 {
+		t.Fatal(resp, err)
+	}
+	_ = resp.Body.Close()
+}
+
+// h2Frame is frame read by test client
+type h2Frame struct {
+	typ      byte
+	flags    byte
+	streamID uint32
+	payload  []byte
+}
+
+func writeH2Frame(t *testing.T, conn net.Conn, typ byte, flags byte, streamID uint32, payload []byte) {
+	t.Helper()
+	header := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags}
+	header = binary.BigEndian.AppendUint32(header, streamID)
+	if _, err := conn.Write(append(header, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readH2Frame(t *testing.T, br *bufio.Reader) h2Frame {
+	t.Helper()
+	var header [h2FrameHeaderSize]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	f := h2Frame{typ: header[3], flags: header[4], streamID: binary.BigEndian.Uint32(header[5:]) & h2MaxWindow}
+	f.payload = make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+	if _, err := io.ReadFull(br, f.payload); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// dialH2 sends preface with empty SETTINGS and returns server SETTINGS
+func dialH2(t *testing.T, addr string) (net.Conn, *bufio.Reader, h2Frame) {
+	conn := dial(t, addr)
+	_, _ = io.WriteString(conn, h2Preface)
+	writeH2Frame(t, conn, H2_FRAME_SETTINGS, 0, 0, nil)
+	br := bufio.NewReader(conn)
+	settings := readH2Frame(t, br)
+	if settings.typ != H2_FRAME_SETTINGS {
+		t.Fatal(settings)
+	}
+	return conn, br, settings
+}
+
+// nextH2Frame skips SETTINGS ACK and WINDOW_UPDATE frames
+func nextH2Frame(t *testing.T, br *bufio.Reader) h2Frame {
+	for {
+		f := readH2Frame(t, br)
+		if f.typ != H2_FRAME_SETTINGS && f.typ != H2_FRAME_WINDOW_UPDATE {
+			return f
+		}
+	}
+}
+
+var h2GetBlock = []byte{0x82, 0x86, 0x84} // :method GET, :scheme http, :path /
+
+func TestHTTP2AdvertisesHeaderListSize(t *testing.T) {
+	_, _, settings := dialH2(t, startServer(t, &Server{handler: h2Handler, H2C: true}))
+	for p := settings.payload; len(p) >= 6; p = p[6:] {
+		if binary.BigEndian.Uint16(p) == H2_SETTINGS_MAX_HEADER_LIST_SIZE && binary.BigEndian.Uint32(p[2:]) == h2MaxHeaderListSize {
+			return
+		}
+	}
+	t.Fatalf("%x", settings.payload)
+}
+
+func TestHTTP2HeaderListTooLarge(t *testing.T) {
+	conn, br, _ := dialH2(t, startServer(t, &Server{handler: h2Handler, H2C: true}))
+	// Small block, but each indexed field repeats 4 KB entry from dynamic table
+	block := append([]byte{}, h2GetBlock...)
+	block = append(block, 0x40, 5)
+	block = append(block, "x-big"...)
+	block = hpackAppendInt(block, 0, 7, 4000)
+	block = append(block, bytes.Repeat([]byte{'v'}, 4000)...)
+	block = append(block, bytes.Repeat([]byte{0xbe}, 20)...)
+	writeH2Frame(t, conn, H2_FRAME_HEADERS, H2_FLAG_END_HEADERS|H2_FLAG_END_STREAM, 1, block)
+	if f := nextH2Frame(t, br); f.typ != H2_FRAME_RST_STREAM || f.streamID != 1 {
+		t.Fatalf("%+v", f)
+	}
+	// Decoder state is kept, so connection is still usable
+	writeH2Frame(t, conn, H2_FRAME_HEADERS, H2_FLAG_END_HEADERS|H2_FLAG_END_STREAM, 3, append(h2GetBlock, 0xbe))
+	if f := nextH2Frame(t, br); f.typ != H2_FRAME_HEADERS || f.streamID != 3 {
+		t.Fatalf("%+v", f)
+	}
+}
+
+func TestHTTP2TableSizeUpdateAfterField(t *testing.T) {
+	conn, br, _ := dialH2(t, startServer(t, &Server{handler: h2Handler, H2C: true}))
+	writeH2Frame(t, conn, H2_FRAME_HEADERS, H2_FLAG_END_HEADERS|H2_FLAG_END_STREAM, 1, append(h2GetBlock, 0x20))
+	f := nextH2Frame(t, br)
+	if f.typ != H2_FRAME_GOAWAY || binary.BigEndian.Uint32(f.payload[4:]) != H2_COMPRESSION_ERROR {
+		t.Fatalf("%+v", f)
+	}
+}
+
+func TestHTTP2Upgrade(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: h2Handler, H2C: true}))
+	_, _ = io.WriteString(conn, "GET /up?a=1 HTTP/1.1\r\nHost: example\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\nX-Custom: c\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != 101 {
+		t.Fatal(resp, err)
+	}
+	_, _ = io.WriteString(conn, h2Preface)
+	writeH2Frame(t, conn, H2_FRAME_SETTINGS, 0, 0, nil)
+	var data []byte
+	for {
+		f := readH2Frame(t, br)
+		if f.typ == H2_FRAME_DATA && f.streamID == 1 {
+			data = append(data, f.payload...)
+			if f.flags&H2_FLAG_END_STREAM != 0 {
+				break
+			}
+		}
+	}
+	if string(data) != "GET /up a=1 v2 len=0 hdr=c" {
+		t.Fatalf("%q", data)
+	}
+}
+
+func TestHTTP2PrefaceWithoutH2C(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: h2Handler}))
+	_, _ = io.WriteString(conn, h2Preface)
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil && resp.StatusCode < 400 {
+		t.Fatal(resp.Status)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Middleware wraps Handler, for example to add logging, auth, compression or metrics
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler with middlewares, first middleware is the outermost, so it runs first
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// WriterInterceptor wraps ResponseWriter so middleware can see and change status and headers
+// before they reach the wrapped writer (and outgoingBuffer). Status 200 is written through
+// OnStatus too, if handler skips WriteStatus or flushes first. After Hijack handler writes to
+// connection directly, so nothing more is intercepted.
+type WriterInterceptor struct {
+	ResponseWriter
+
+	OnStatus func(statusCode int) int                      // Returns status to write
+	OnHeader func(key string, value string) (string, bool) // Called for WriteOtherHeader and WriteSetCookie, returns value to write, false drops header
+
+	StatusCode   int // 0 until status is written
+	BytesWritten int64
+	Hijacked     bool
+}
+
+func (w *WriterInterceptor) ensureStatus() {
+	if w.StatusCode == 0 {
+		w.WriteStatus(200)
+	}
+}
+
+func (w *WriterInterceptor) WriteStatus(statusCode int) {
+	if w.StatusCode != 0 {
+		return
+	}
+	if w.OnStatus != nil {
+		statusCode = w.OnStatus(statusCode)
+	}
+	w.StatusCode = statusCode
+	w.ResponseWriter.WriteStatus(statusCode)
+}
+
+func (w *WriterInterceptor) WriteDate(date string) {
+	w.ensureStatus()
+	w.ResponseWriter.WriteDate(date)
+}
+
+func (w *WriterInterceptor) WriteServer(server string) {
+	w.ensureStatus()
+	w.ResponseWriter.WriteServer(server)
+}
+
+func (w *WriterInterceptor) WriteContentLength(length int64) {
+	w.ensureStatus()
+	w.ResponseWriter.WriteContentLength(length)
+}
+
+func (w *WriterInterceptor) WriteOtherHeader(key string, value string) {
+	w.ensureStatus()
+	if w.OnHeader != nil {
+		var ok bool
+		if value, ok = w.OnHeader(key, value); !ok {
+			return
+		}
+	}
+	w.ResponseWriter.WriteOtherHeader(key, value)
+}
+
+// WriteSetCookie formats cookie for OnHeader only if it is set. Changed value is written as other header.
+func (w *WriterInterceptor) WriteSetCookie(cookie *Cookie) error {
+	w.ensureStatus()
+	if w.OnHeader != nil {
+		if err := cookie.validate(); err != nil {
+			return err
+		}
+		formatted := string(appendCookie(nil, cookie))
+		value, ok := w.OnHeader("set-cookie", formatted)
+		if !ok {
+			return nil
+		}
+		if value != formatted {
+			w.ResponseWriter.WriteOtherHeader("set-cookie", value)
+			return nil
+		}
+	}
+	return w.ResponseWriter.WriteSetCookie(cookie)
+}
+
+func (w *WriterInterceptor) Write(data []byte) (int, error) {
+	w.ensureStatus()
+	n, err := w.ResponseWriter.Write(data)
+	w.BytesWritten += int64(n)
+	return n, err
+}
+
+func (w *WriterInterceptor) Flush() error {
+	w.ensureStatus()
+	return w.ResponseWriter.Flush()
+}
+
+// ReadFrom keeps sendfile of wrapped writer if there are no hooks, body itself is never changed
+func (w *WriterInterceptor) ReadFrom(src io.Reader) (int64, error) {
+	w.ensureStatus()
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok && w.OnStatus == nil && w.OnHeader == nil {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{w.ResponseWriter}, src)
+	}
+	w.BytesWritten += n
+	return n, err
+}
+
+func (w *WriterInterceptor) Hijack() (net.Conn, []byte, []byte, error) {
+	conn, incoming, outgoing, err := w.ResponseWriter.Hijack()
+	if err == nil {
+		w.Hijacked = true
+	}
+	return conn, incoming, outgoing, err
+}
+
+// Interceptors escape to handler, so they are pooled instead of allocated per request
+var writerInterceptors = sync.Pool{New: func() interface{} { return &WriterInterceptor{} }}
+
+// LogRequests is an example middleware, logs method, path, status, size and duration
+func LogRequests(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(wr ResponseWriter, r *Request) {
+			start := time.Now()
+			w := writerInterceptors.Get().(*WriterInterceptor)
+			*w = WriterInterceptor{ResponseWriter: wr}
+			next(w, r)
+			status := strconv.Itoa(w.StatusCode)
+			if w.Hijacked {
+				status = "hijacked"
+			}
+			logger.Printf("%s %s %s %d %v", r.Method, r.Path, status, w.BytesWritten, time.Since(start))
+			*w = WriterInterceptor{} // Do not keep connection reachable from pool
+			writerInterceptors.Put(w)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewareChainOrderAndInterceptor(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(wr ResponseWriter, r *Request) {
+				order = append(order, name)
+				w := &WriterInterceptor{ResponseWriter: wr,
+					OnStatus: func(statusCode int) int { return statusCode + 1 },
+					OnHeader: func(key string, value string) (string, bool) {
+						if key == "x-version" {
+							return value + "-" + name, true
+						}
+						return value, !strings.HasPrefix(key, "x-secret")
+					}}
+				next(w, r)
+			}
+		}
+	}
+	h := Chain(func(wr ResponseWriter, r *Request) {
+		wr.WriteOtherHeader("x-secret", "1")
+		wr.WriteOtherHeader("x-public", "1")
+		wr.WriteOtherHeader("x-version", "v")
+		wr.WriteContentLength(2)
+		_, _ = wr.Write([]byte("ok"))
+	}, mw("a"), mw("b"))
+	resp, body := roundTrip(t, dial(t, startServer(t, &Server{handler: h})), "GET / HTTP/1.1\r\n\r\n")
+	if resp.StatusCode != 202 || body != "ok" || strings.Join(order, "") != "ab" {
+		t.Fatal(resp.StatusCode, body, order)
+	}
+	if resp.Header.Get("x-secret") != "" || resp.Header.Get("x-public") != "1" || resp.Header.Get("x-version") != "v-b-a" {
+		t.Fatal(resp.Header)
+	}
+}
+
+func TestMiddlewareReplacesSetCookie(t *testing.T) {
+	secure := func(next Handler) Handler {
+		return func(wr ResponseWriter, r *Request) {
+			next(&WriterInterceptor{ResponseWriter: wr, OnHeader: func(key string, value string) (string, bool) {
+				if key == "set-cookie" && !strings.Contains(value, "; Secure") {
+					value += "; Secure"
+				}
+				return value, true
+			}}, r)
+		}
+	}
+	h := Chain(func(wr ResponseWriter, r *Request) {
+		_ = wr.WriteSetCookie(&Cookie{Name: "a", Value: "1"})
+		_ = wr.WriteSetCookie(&Cookie{Name: "b", Value: "2", Secure: true})
+		wr.WriteContentLength(0)
+		_, _ = wr.Write(nil)
+	}, secure)
+	resp, _ := roundTrip(t, dial(t, startServer(t, &Server{handler: h})), "GET / HTTP/1.1\r\n\r\n")
+	if got := resp.Header.Values("Set-Cookie"); len(got) != 2 || got[0] != "a=1; Secure" || got[1] != "b=2; Secure" {
+		t.Fatal(got)
+	}
+}
+
+// chanWriter passes each log line to test, because it is logged after response is sent
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestLogRequests(t *testing.T) {
+	lines := make(chanWriter, 2)
+	h := Chain(func(wr ResponseWriter, r *Request) {
+		wr.WriteStatus(404)
+		wr.WriteContentLength(3)
+		_, _ = wr.Write([]byte("abc"))
+	}, LogRequests(log.New(lines, "", 0)))
+	conn := dial(t, startServer(t, &Server{handler: h}))
+	for _, path := range []string{"/a", "/b"} { // Second request reuses pooled interceptor
+		if resp, _ := roundTrip(t, conn, "GET "+path+" HTTP/1.1\r\n\r\n"); resp.StatusCode != 404 {
+			t.Fatal(resp.StatusCode)
+		}
+		if line := <-lines; !strings.HasPrefix(line, "GET "+path+" 404 3 ") {
+			t.Fatalf("%q", line)
+		}
+	}
+}
+
+// Flush before any write commits status, so it must go through OnStatus
+func TestInterceptorFlushWritesStatus(t *testing.T) {
+	statuses := make(chan int, 1)
+	mw := func(next Handler) Handler {
+		return func(wr ResponseWriter, r *Request) {
+			w := &WriterInterceptor{ResponseWriter: wr, OnStatus: func(statusCode int) int { return 203 }}
+			next(w, r)
+			statuses <- w.StatusCode
+		}
+	}
+	h := Chain(func(wr ResponseWriter, r *Request) {
+		_ = wr.Flush()
+		_, _ = wr.Write([]byte("ok"))
+	}, mw)
+	resp, body := roundTrip(t, dial(t, startServer(t, &Server{handler: h})), "GET / HTTP/1.1\r\n\r\n")
+	if resp.StatusCode != 203 || body != "ok" {
+		t.Fatal(resp.StatusCode, body)
+	}
+	if status := <-statuses; status != 203 {
+		t.Fatal(status)
+	}
+}
+
+func TestLogRequestsHijack(t *testing.T) {
+	lines := make(chanWriter, 1)
+	h := Chain(func(wr ResponseWriter, r *Request) {
+		conn, _, _, err := wr.Hijack()
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(conn, "raw")
+		_ = conn.Close()
+	}, LogRequests(log.New(lines, "", 0)))
+	conn := dial(t, startServer(t, &Server{handler: h}))
+	_, _ = io.WriteString(conn, "GET /ws HTTP/1.1\r\n\r\n")
+	if b, _ := io.ReadAll(conn); string(b) != "raw" {
+		t.Fatalf("%q", b)
+	}
+	if line := <-lines; !strings.HasPrefix(line, "GET /ws hijacked 0 ") {
+		t.Fatalf("%q", line)
+	}
+}
+
+// readFromRecorder is ResponseWriter which tells if its ReadFrom was used
+type readFromRecorder struct {
+	ResponseWriter
+	status   int
+	body     strings.Builder
+	readFrom bool
+}
+
+func (rec *readFromRecorder) WriteStatus(statusCode int)     { rec.status = statusCode }
+func (rec *readFromRecorder) Write(data []byte) (int, error) { return rec.body.Write(data) }
+func (rec *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rec.readFrom = true
+	return io.Copy(&rec.body, src)
+}
+
+func TestInterceptorReadFrom(t *testing.T) {
+	for _, hooked := range []bool{false, true} {
+		rec := &readFromRecorder{}
+		w := &WriterInterceptor{ResponseWriter: rec}
+		if hooked {
+			w.OnStatus = func(statusCode int) int { return statusCode }
+		}
+		n, err := io.Copy(w, struct{ io.Reader }{strings.NewReader("file content")}) // Hides WriteTo, like file
+		if err != nil || n != 12 || w.BytesWritten != 12 || rec.body.String() != "file content" || rec.status != 200 {
+			t.Fatalf("hooked %v: %d %v %d %q %d", hooked, n, err, w.BytesWritten, rec.body.String(), rec.status)
+		}
+		if rec.readFrom == hooked {
+			t.Fatalf("hooked %v: ReadFrom of wrapped writer used %v", hooked, rec.readFrom)
+		}
+	}
+}
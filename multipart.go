@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	MULTIPART_PREAMBLE = iota
+	MULTIPART_PART     = iota // Reading part body
+	MULTIPART_BOUNDARY = iota // Part body finished, incomingReadPos points at delimiter
+	MULTIPART_DONE     = iota
+)
+
+const multipartBufferSize = 4096
+const maxBoundarySize = 70 // RFC 2046 section 5.1.1
+const defaultMaxParts = 1000
+const defaultMaxMultipartSize = 32 * 1024 * 1024
+const defaultSpoolThreshold = 1024 * 1024
+
+var ErrNotMultipart = errors.New("Request is not multipart or has no boundary")
+var ErrMultipartTooLarge = errors.New("Multipart body too large")
+var ErrMultipartTooManyParts = errors.New("Too many multipart parts")
+var errMultipartBoundary = errors.New("Invalid multipart boundary line")
+
+// MultipartReader streams parts of multipart body, see Request.MultipartReader.
+// Part headers are limited by maxHeaderSize, like request headers.
+type MultipartReader struct {
+	MaxParts       int   // 0 means defaultMaxParts
+	MaxSize        int64 // Of whole body, 0 means defaultMaxMultipartSize
+	SpoolThreshold int64 // Part.Spool keeps larger files in temporary files, 0 means defaultSpoolThreshold
+
+	c         Client // Parsing engine, reads request body
+	src       multipartSource
+	delimiter []byte // "\r\n--" + boundary
+	headerBuf []byte // Part headers are parsed here, so body reads do not overwrite them
+	state     int
+	parts     int
+	part      Part
+	err       error // Sticky
+	spooled   []*SpooledPart
+}
+
+// multipartSource counts body bytes for MaxSize and hides empty reads from Client routines
+type multipartSource struct {
+	r         io.Reader
+	bytesRead int64
+	maxSize   int64
+}
+
+func (s *multipartSource) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		s.bytesRead += int64(n)
+		if s.bytesRead > s.maxSize {
+			return 0, ErrMultipartTooLarge
+		}
+		if n != 0 || err != nil {
+			if err == io.EOF && n == 0 {
+				err = io.ErrUnexpectedEOF // Body must end with final boundary
+			}
+			return n, err
+		}
+	}
+}
+
+// Part is one part of multipart body, valid until the next NextPart
+type Part struct {
+	Headers           []HeaderKV // Lowercase keys, except content-type which is parsed into fields below
+	ContentTypeMime   []byte
+	ContentTypeSuffix []byte
+	Name              []byte // Of content-disposition, form field name
+	FileName          []byte // Of content-disposition, nil if part is not a file
+
+	mr *MultipartReader
+}
+
+// MultipartReader returns reader of multipart body, boundary is taken from ContentTypeSuffix
+func (r *Request) MultipartReader() (*MultipartReader, error) {
+	if !bytes.HasPrefix(r.ContentTypeMime, []byte("multipart/")) {
+		return nil, ErrNotMultipart
+	}
+	var boundary []byte
+	visitHeaderParams(r.ContentTypeSuffix, func(name []byte, value []byte) {
+		if bytes.EqualFold(name, []byte("boundary")) {
+			boundary = value
+		}
+	})
+	if len(boundary) == 0 || len(boundary) > maxBoundarySize {
+		return nil, ErrNotMultipart
+	}
+	mr := &MultipartReader{delimiter: append([]byte("\r\n--"), boundary...)}
+	mr.src.r = r.Body()
+	mr.c.incomingBuffer = make([]byte, multipartBufferSize)
+	mr.c.incomingReader = &mr.src
+	mr.part.mr = mr
+	return mr, nil
+}
+
+// NextPart skips the rest of current part and returns the next one, io.EOF after the last
+func (mr *MultipartReader) NextPart() (*Part, error) {
+	if mr.err != nil {
+		return nil, mr.err
+	}
+	if mr.src.maxSize == 0 {
+		mr.src.maxSize = mr.MaxSize
+		if mr.src.maxSize <= 0 {
+			mr.src.maxSize = defaultMaxMultipartSize
+		}
+	}
+	if err := mr.nextPart(); err != nil {
+		mr.err = err
+		return nil, err
+	}
+	return &mr.part, nil
+}
+
+func (mr *MultipartReader) nextPart() error {
+	c := &mr.c
+	delimiterSize := len(mr.delimiter)
+	if mr.state == MULTIPART_PREAMBLE {
+		if err := mr.fill(delimiterSize - 2); err != nil {
+			return err
+		}
+		if bytes.HasPrefix(c.incomingBuffer[c.incomingReadPos:c.incomingWritePos], mr.delimiter[2:]) {
+			delimiterSize -= 2 // Body starts with boundary, no CRLF before it
+		} else {
+			mr.state = MULTIPART_PART // Preamble is skipped like part body
+		}
+	}
+	if mr.state == MULTIPART_PART {
+		var scratch [512]byte
+		for {
+			if _, err := mr.part.Read(scratch[:]); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	c.incomingReadPos += delimiterSize
+	if err := mr.fill(2); err != nil {
+		return err
+	}
+	if c.incomingBuffer[c.incomingReadPos] == '-' && c.incomingBuffer[c.incomingReadPos+1] == '-' {
+		mr.state = MULTIPART_DONE
+		return io.EOF // Epilogue is left unread, server discards it
+	}
+	mr.parts++
+	maxParts := mr.MaxParts
+	if maxParts <= 0 {
+		maxParts = defaultMaxParts
+	}
+	if mr.parts > maxParts {
+		return ErrMultipartTooManyParts
+	}
+	// Rest of boundary line followed by headers looks like request line and headers to readComplete
+	if err := c.readComplete(); err != nil {
+		return err
+	}
+	mr.headerBuf = append(mr.headerBuf[:0], c.incomingBuffer[c.incomingReadPos:c.incomingWritePos]...)
+	pos := 0
+	for pos < len(mr.headerBuf) && isSP(mr.headerBuf[pos]) { // Transport padding
+		pos++
+	}
+	if pos < len(mr.headerBuf) && mr.headerBuf[pos] == '\r' {
+		pos++
+	}
+	if pos == len(mr.headerBuf) || mr.headerBuf[pos] != '\n' {
+		return errMultipartBoundary
+	}
+	pos++
+	r := &c.request
+	r.ContentLength = -1
+	r.ContentTypeMime = nil
+	r.ContentTypeSuffix = nil
+	r.TransferEncodings = r.TransferEncodings[:0]
+	r.TransferEncodingChunked = false
+	r.Headers = r.Headers[:0]
+	if !c.parseHeaders(mr.headerBuf, &pos) {
+		return errors.New("Invalid multipart part header")
+	}
+	c.incomingReadPos += pos
+	mr.state = MULTIPART_PART
+
+	p := &mr.part
+	p.Headers = r.Headers
+	p.ContentTypeMime = r.ContentTypeMime
+	p.ContentTypeSuffix = r.ContentTypeSuffix
+	p.Name = nil
+	p.FileName = nil
+	if disposition := p.Header("content-disposition"); disposition != nil {
+		if semi := bytes.IndexByte(disposition, ';'); semi >= 0 {
+			disposition = disposition[semi+1:]
+		}
+		visitHeaderParams(disposition, func(name []byte, value []byte) {
+			if bytes.EqualFold(name, []byte("name")) {
+				p.Name = value
+			} else if bytes.EqualFold(name, []byte("filename")) {
+				p.FileName = value
+			}
+		})
+	}
+	return nil
+}
+
+// fill reads until at least n bytes are buffered
+func (mr *MultipartReader) fill(n int) error {
+	c := &mr.c
+	for c.incomingWritePos-c.incomingReadPos < n {
+		if c.incomingWritePos == len(c.incomingBuffer) { // Defragment
+			c.incomingWritePos = copy(c.incomingBuffer, c.incomingBuffer[c.incomingReadPos:c.incomingWritePos])
+			c.incomingReadPos = 0
+		}
+		if err := c.readMore(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Header returns value of the last part header with lowerKey, nil if not found
+func (p *Part) Header(lowerKey string) []byte {
+	for i := len(p.Headers) - 1; i >= 0; i-- {
+		if string(p.Headers[i].key) == lowerKey {
+			return p.Headers[i].value
+		}
+	}
+	return nil
+}
+
+// Read reads part body, io.EOF at the next boundary
+func (p *Part) Read(b []byte) (int, error) {
+	mr := p.mr
+	if mr.state != MULTIPART_PART {
+		return 0, io.EOF
+	}
+	c := &mr.c
+	for {
+		buffered := c.incomingBuffer[c.incomingReadPos:c.incomingWritePos]
+		if end := bytes.Index(buffered, mr.delimiter); end >= 0 {
+			n := copy(b, buffered[:end])
+			c.incomingReadPos += n
+			if n == end {
+				mr.state = MULTIPART_BOUNDARY
+				if n == 0 {
+					return 0, io.EOF
+				}
+			}
+			return n, nil
+		}
+		// Tail can be beginning of delimiter
+		if safe := len(buffered) - len(mr.delimiter) + 1; safe > 0 {
+			n := copy(b, buffered[:safe])
+			c.incomingReadPos += n
+			return n, nil
+		}
+		if err := mr.fill(len(buffered) + 1); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// SpooledPart is content of a part read by Part.Spool, in memory or in temporary file
+type SpooledPart struct {
+	Name        string
+	FileName    string
+	ContentType string
+	Size        int64
+
+	data []byte
+	path string // Of temporary file, empty if in memory
+}
+
+// Spool reads the whole part, so it survives NextPart. Contents larger than SpoolThreshold
+// go to temporary file, which is removed by MultipartReader.RemoveAll.
+func (p *Part) Spool() (*SpooledPart, error) {
+	mr := p.mr
+	threshold := mr.SpoolThreshold
+	if threshold <= 0 {
+		threshold = defaultSpoolThreshold
+	}
+	sp := &SpooledPart{Name: string(p.Name), FileName: string(p.FileName), ContentType: string(p.ContentTypeMime)}
+	if len(p.ContentTypeSuffix) != 0 {
+		sp.ContentType += "; " + string(p.ContentTypeSuffix)
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(p, threshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= threshold {
+		sp.data = buf.Bytes()
+		sp.Size = n
+		return sp, nil
+	}
+	f, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return nil, err
+	}
+	sp.path = f.Name()
+	mr.spooled = append(mr.spooled, sp)
+	written, err := io.Copy(f, io.MultiReader(&buf, p))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	sp.Size = written
+	if err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// InMemory tells if content is kept in memory, not in temporary file
+func (sp *SpooledPart) InMemory() bool { return sp.path == "" }
+
+// Open returns reader of content, caller must close it
+func (sp *SpooledPart) Open() (io.ReadSeekCloser, error) {
+	if sp.path == "" {
+		return nopSeekCloser{bytes.NewReader(sp.data)}, nil
+	}
+	return os.Open(sp.path)
+}
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// RemoveAll removes temporary files of spooled parts, usually deferred after Request.MultipartReader
+func (mr *MultipartReader) RemoveAll() error {
+	var firstErr error
+	for _, sp := range mr.spooled {
+		if err := os.Remove(sp.path); err != nil && firstErr == nil && !errors.Is(err, os.ErrNotExist) {
+			firstErr = err
+		}
+	}
+	mr.spooled = mr.spooled[:0]
+	return firstErr
+}
+
+// visitHeaderParams calls f for every "name=value" of "; " separated parameters, like content-type
+// suffix. params are not changed, names keep their case, quoted value with escapes is unescaped into a copy.
+func visitHeaderParams(params []byte, f func(name []byte, value []byte)) {
+	pos := 0
+	for {
+		for pos < len(params) && (isSP(params[pos]) || params[pos] == ';') {
+			pos++
+		}
+		if pos == len(params) {
+			return
+		}
+		nameStart := pos
+		for pos < len(params) && params[pos] != '=' && params[pos] != ';' && !isSP(params[pos]) {
+			pos++
+		}
+		name := params[nameStart:pos]
+		for pos < len(params) && isSP(params[pos]) {
+			pos++
+		}
+		if pos == len(params) || params[pos] != '=' {
+			continue // Parameter without value is ignored
+		}
+		pos++
+		for pos < len(params) && isSP(params[pos]) {
+			pos++
+		}
+		var value []byte
+		if pos < len(params) && params[pos] == '"' {
+			pos++
+			valueStart, escaped := pos, false
+			for pos < len(params) && params[pos] != '"' {
+				if params[pos] == '\\' && pos+1 < len(params) {
+					escaped = true
+					pos++
+				}
+				pos++
+			}
+			value = params[valueStart:pos]
+			if escaped {
+				value = unescapeQuoted(value)
+			}
+			pos++ // Closing quote
+		} else {
+			valueStart := pos
+			for pos < len(params) && params[pos] != ';' && !isSP(params[pos]) {
+				pos++
+			}
+			value = params[valueStart:pos]
+		}
+		f(name, value)
+	}
+}
+
+// unescapeQuoted returns copy of quoted-string content with quoted-pairs replaced by the escaped byte
+func unescapeQuoted(b []byte) []byte {
+	result := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) {
+			i++
+		}
+		result = append(result, b[i])
+	}
+	return result
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var multipartFile = bytes.Repeat([]byte("0123456789\r\n-"), 3000) // Looks like start of delimiter often
+
+var multipartWant = fmt.Sprint([]string{
+	"title|||11|hello world",
+	`upload|we"ird.txt|application/octet-stream|39000|0123456789` + "\r",
+	"empty|||0|",
+})
+
+// multipartForm returns content type and body with a field, a file and an empty field
+func multipartForm(t *testing.T) (string, []byte) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := w.WriteField("title", "hello world"); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := w.CreateFormFile("upload", `we"ird.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write(multipartFile)
+	_ = w.WriteField("empty", "")
+	_ = w.Close()
+	return w.FormDataContentType(), buf.Bytes()
+}
+
+func multipartRequest(contentType string, body io.Reader) *Request {
+	r := &Request{ContentLength: -1}
+	r.ContentTypeMime, r.ContentTypeSuffix = parseContentTypeValue([]byte(contentType))
+	r.body = body
+	return r
+}
+
+// readParts describes every part as "name|filename|mime|size|start of content"
+func readParts(mr *MultipartReader) ([]string, error) {
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return parts, err
+		}
+		b, err := io.ReadAll(p)
+		if err != nil {
+			return parts, err
+		}
+		parts = append(parts, fmt.Sprintf("%s|%s|%s|%d|%s", p.Name, p.FileName, p.ContentTypeMime, len(b), b[:min(len(b), 11)]))
+	}
+}
+
+func TestMultipartReader(t *testing.T) {
+	contentType, body := multipartForm(t)
+	for _, src := range []io.Reader{
+		bytes.NewReader(body),
+		iotest.OneByteReader(bytes.NewReader(body)),
+		iotest.HalfReader(bytes.NewReader(body)),
+	} {
+		mr, err := multipartRequest(contentType, src).MultipartReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts, err := readParts(mr)
+		if got := fmt.Sprint(parts); err != nil || got != multipartWant {
+			t.Fatalf("%q, %v", got, err)
+		}
+	}
+}
+
+// Preamble, transport padding, skipping unread part and quoted boundary
+func TestMultipartFraming(t *testing.T) {
+	raw := "preamble\r\n--b 1\r\nX: y\r\n\r\nfirst\r\n--b 1  \r\n\r\nsecond\r\n--b 1--\r\nepilogue"
+	mr, err := multipartRequest(`multipart/mixed; boundary="b 1"`, strings.NewReader(raw)).MultipartReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := mr.NextPart()
+	if err != nil || string(p.Header("x")) != "y" {
+		t.Fatal(err)
+	}
+	p, err = mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(p); string(b) != "second" {
+		t.Fatalf("%q", b)
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+// Escaped boundary is unescaped into a copy, so ContentTypeSuffix stays as received
+func TestMultipartBoundaryNotChanged(t *testing.T) {
+	const suffix = `Boundary="a\"b"; charset=utf-8`
+	raw := "--a\"b\r\nContent-Disposition: form-data; Name=\"f\\\"x\"; filename=\"1.txt\"\r\n\r\ndata\r\n--a\"b--"
+	r := multipartRequest("multipart/form-data; "+suffix, strings.NewReader(raw))
+	for i := 0; i < 2; i++ { // The second call sees the same bytes
+		mr, err := r.MultipartReader()
+		if err != nil || string(mr.delimiter) != "\r\n--a\"b" {
+			t.Fatal(i, err)
+		}
+		if string(r.ContentTypeSuffix) != suffix {
+			t.Fatalf("%q", r.ContentTypeSuffix)
+		}
+	}
+	mr, _ := multipartRequest("multipart/form-data; "+suffix, strings.NewReader(raw)).MultipartReader()
+	parts, err := readParts(mr)
+	if got := fmt.Sprint(parts); err != nil || got != `[f"x|1.txt||4|data]` {
+		t.Fatalf("%q, %v", got, err)
+	}
+}
+
+func TestMultipartErrors(t *testing.T) {
+	contentType, body := multipartForm(t)
+	mr, _ := multipartRequest(contentType, bytes.NewReader(body)).MultipartReader()
+	mr.MaxParts = 2
+	if _, err := readParts(mr); !errors.Is(err, ErrMultipartTooManyParts) {
+		t.Fatal(err)
+	}
+	mr, _ = multipartRequest(contentType, bytes.NewReader(body)).MultipartReader()
+	mr.MaxSize = 10000
+	if _, err := readParts(mr); !errors.Is(err, ErrMultipartTooLarge) {
+		t.Fatal(err)
+	}
+	mr, _ = multipartRequest(contentType, bytes.NewReader(body[:len(body)-10])).MultipartReader()
+	if _, err := readParts(mr); err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	longHeader := "--b\r\nX: " + strings.Repeat("a", 5000) + "\r\n\r\nx\r\n--b--"
+	mr, _ = multipartRequest("multipart/form-data; boundary=b", strings.NewReader(longHeader)).MultipartReader()
+	if _, err := mr.NextPart(); err == nil {
+		t.Fatal("long part header accepted")
+	}
+	for _, contentType := range []string{"multipart/form-data", "text/plain; boundary=b", "multipart/form-data; boundary=" + strings.Repeat("b", 71)} {
+		if _, err := multipartRequest(contentType, strings.NewReader("")).MultipartReader(); err != ErrNotMultipart {
+			t.Fatalf("%q: %v", contentType, err)
+		}
+	}
+}
+
+func TestMultipartSpool(t *testing.T) {
+	contentType, body := multipartForm(t)
+	mr, _ := multipartRequest(contentType, bytes.NewReader(body)).MultipartReader()
+	mr.SpoolThreshold = 1000
+	var spooled []*SpooledPart
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sp, err := p.Spool()
+		if err != nil {
+			t.Fatal(err)
+		}
+		spooled = append(spooled, sp)
+	}
+	if len(spooled) != 3 || !spooled[0].InMemory() || spooled[1].InMemory() || spooled[1].Size != int64(len(multipartFile)) {
+		t.Fatal(spooled)
+	}
+	f, err := spooled[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(f)
+	_ = f.Close()
+	if !bytes.Equal(b, multipartFile) {
+		t.Fatal("spooled content differs")
+	}
+	if err := mr.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spooled[1].Open(); err == nil {
+		t.Fatal("temp file not removed")
+	}
+}
+
+func TestRequestMultipartReader(t *testing.T) {
+	h := func(wr ResponseWriter, r *Request) {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			writeSimpleResponse(wr, 400, "")
+			return
+		}
+		parts, err := readParts(mr)
+		result := fmt.Sprint(parts)
+		if err != nil {
+			result = err.Error()
+		}
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}
+	conn := dial(t, startServer(t, &Server{handler: h}))
+	contentType, body := multipartForm(t)
+	for i := 0; i < 2; i++ { // Buffers are reused by the next request
+		req := fmt.Sprintf("POST / HTTP/1.1\r\nContent-Type: %s\r\nTransfer-Encoding: chunked\r\n\r\n%s", contentType, oneChunk(body))
+		if _, got := roundTrip(t, conn, req); got != multipartWant {
+			t.Fatalf("%q", got)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+)
+
+// FromHTTPHandler runs net/http handler on schwidko, for incremental migration.
+// Unlike the rest of schwidko, it allocates http.Request and headers for every request.
+func FromHTTPHandler(h http.Handler) Handler {
+	return func(wr ResponseWriter, r *Request) {
+		w := httpResponseWriter{wr: wr, header: http.Header{}}
+		h.ServeHTTP(&w, newHTTPRequest(r))
+		if !w.hijacked && !w.wroteHeader {
+			w.WriteHeader(200)
+		}
+	}
+}
+
+func newHTTPRequest(r *Request) *http.Request {
+	header := make(http.Header, len(r.Headers)+4)
+	for _, kv := range r.Headers {
+		header.Add(http.CanonicalHeaderKey(string(kv.key)), string(kv.value))
+	}
+	// Fields parsed by processReadyHeader are not in r.Headers
+	if len(r.Origin) != 0 {
+		header.Set("Origin", string(r.Origin))
+	}
+	if len(r.ContentTypeMime) != 0 {
+		contentType := string(r.ContentTypeMime)
+		if len(r.ContentTypeSuffix) != 0 {
+			contentType += "; " + string(r.ContentTypeSuffix)
+		}
+		header.Set("Content-Type", contentType)
+	}
+	if len(r.BasicAuthorization) != 0 {
+		header.Set("Authorization", "Basic "+string(r.BasicAuthorization))
+	}
+	for _, kv := range r.HopByHopHeaders {
+		header.Add(http.CanonicalHeaderKey(string(kv.key)), string(kv.value))
+	}
+	for _, token := range r.ConnectionTokens {
+		header.Add("Connection", string(token))
+	}
+	for _, protocol := range r.UpgradeProtocols {
+		header.Add("Upgrade", string(protocol))
+	}
+	if len(r.SecWebsocketKey) != 0 {
+		header.Set("Sec-Websocket-Key", string(r.SecWebsocketKey))
+	}
+	if len(r.SecWebsocketVersion) != 0 {
+		header.Set("Sec-Websocket-Version", string(r.SecWebsocketVersion))
+	}
+	u := &url.URL{Path: string(r.Path), RawQuery: string(r.QueryString)}
+	req := &http.Request{
+		Method:     string(r.Method),
+		URL:        u,
+		Proto:      "HTTP/" + strconv.Itoa(r.VersionMajor) + "." + strconv.Itoa(r.VersionMinor),
+		ProtoMajor: r.VersionMajor,
+		ProtoMinor: r.VersionMinor,
+		Header:     header,
+		Host:       string(r.Host),
+		Close:      !r.KeepAlive,
+		RequestURI: u.RequestURI(),
+		TLS:        r.TLS,
+		Body:       http.NoBody,
+	}
+	if r.RemoteAddr != nil {
+		req.RemoteAddr = r.RemoteAddr.String()
+	}
+	switch {
+	case r.TransferEncodingChunked:
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Body = io.NopCloser(r.RawBody())
+	case r.ContentLength > 0:
+		req.ContentLength = r.ContentLength
+		req.Body = io.NopCloser(r.RawBody())
+		header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+	return req.WithContext(r.Context())
+}
+
+// httpResponseWriter implements http.ResponseWriter, http.Flusher and http.Hijacker over ResponseWriter
+type httpResponseWriter struct {
+	wr          ResponseWriter
+	header      http.Header
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *httpResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *httpResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+	if statusCode >= 100 && statusCode <= 199 && statusCode != 101 {
+		return // Informational responses are not supported
+	}
+	w.wroteHeader = true
+	w.wr.WriteStatus(statusCode)
+	for key, values := range w.header {
+		switch key {
+		case "Content-Length":
+			if len(values) != 0 {
+				if length, err := strconv.ParseInt(values[0], 10, 64); err == nil {
+					w.wr.WriteContentLength(length)
+				}
+			}
+			continue
+		case "Date":
+			if len(values) != 0 {
+				w.wr.WriteDate(values[0])
+			}
+			continue
+		case "Server":
+			if len(values) != 0 {
+				w.wr.WriteServer(values[0])
+			}
+			continue
+		}
+		for _, value := range values {
+			w.wr.WriteOtherHeader(key, value)
+		}
+	}
+}
+
+func (w *httpResponseWriter) Write(data []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !w.wroteHeader {
+		if _, ok := w.header["Content-Type"]; !ok && len(data) != 0 {
+			w.header.Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(200)
+	}
+	return w.wr.Write(data)
+}
+
+func (w *httpResponseWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	_ = w.wr.Flush()
+}
+
+func (w *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, incoming, outgoing, err := w.wr.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	if len(outgoing) != 0 {
+		if _, err := conn.Write(outgoing); err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+	}
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(incoming), conn))
+	return conn, bufio.NewReadWriter(reader, bufio.NewWriter(conn)), nil
+}
+
+// ToHTTPHandler exposes schwidko Handler as http.Handler, for mounting into net/http mux.
+// Request fields are filled from copies of *http.Request data, because net/http owns its buffers.
+func ToHTTPHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := Client{} // Only for processReadyHeader, so fields are set exactly as by our parser
+		r := &c.request
+		fillRequest(&c, req)
+		wr := fromHTTPResponseWriter{w: w}
+		h(&wr, r)
+		if !wr.hijacked {
+			wr.writeHeader()
+		}
+	})
+}
+
+func fillRequest(c *Client, req *http.Request) {
+	r := &c.request
+	r.Method = []byte(req.Method)
+	r.Path = []byte(req.URL.Path)
+	r.QueryString = []byte(req.URL.RawQuery)
+	r.RawTarget = []byte(req.URL.RequestURI())
+	r.VersionMajor = req.ProtoMajor
+	r.VersionMinor = req.ProtoMinor
+	r.KeepAlive = !req.Close
+	r.ContentLength = -1
+	r.Host = []byte(req.Host)
+	r.TLS = req.TLS
+	if req.TLS != nil {
+		r.PeerCertificates = req.TLS.PeerCertificates
+	}
+	if addrPort, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+		r.RemoteAddr = net.TCPAddrFromAddrPort(addrPort)
+	}
+	r.body = req.Body
+	r.ctx = req.Context()
+	for key, values := range req.Header {
+		lowerKey := []byte(key)
+		toTowerSlice(lowerKey)
+		c.headerCMSList = isCMSListHeader(lowerKey)
+		for _, value := range values {
+			if !c.headerCMSList {
+				_ = c.processReadyHeader(lowerKey, []byte(value))
+				continue
+			}
+			for _, token := range bytes.Split([]byte(value), []byte{','}) {
+				_ = c.processReadyHeader(lowerKey, trimSP(token)) // Unknown tokens are skipped
+			}
+		}
+	}
+	c.headerCMSList = false
+	for _, te := range req.TransferEncoding { // Removed from req.Header by net/http
+		_ = c.processReadyHeader([]byte("transfer-encoding"), []byte(te))
+	}
+	if r.ContentLength < 0 && req.ContentLength > 0 {
+		r.ContentLength = req.ContentLength
+	}
+	r.stripHopByHopHeaders()
+}
+
+// fromHTTPResponseWriter implements ResponseWriter over http.ResponseWriter.
+// Status and headers are kept in http.Header until the first Write or Flush.
+type fromHTTPResponseWriter struct {
+	w           http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (wr *fromHTTPResponseWriter) WriteStatus(statusCode int) {
+	if wr.statusCode == 0 {
+		wr.statusCode = statusCode
+	}
+}
+
+func (wr *fromHTTPResponseWriter) WriteDate(date string) {
+	wr.WriteOtherHeader("Date", date)
+}
+
+func (wr *fromHTTPResponseWriter) WriteServer(server string) {
+	wr.WriteOtherHeader("Server", server)
+}
+
+func (wr *fromHTTPResponseWriter) WriteContentLength(length int64) {
+	wr.WriteOtherHeader("Content-Length", strconv.FormatInt(length, 10))
+}
+
+func (wr *fromHTTPResponseWriter) WriteOtherHeader(key string, value string) {
+	if wr.wroteHeader {
+		return
+	}
+	wr.WriteStatus(200)
+	wr.w.Header().Add(key, value)
+}
+
+func (wr *fromHTTPResponseWriter) WriteSetCookie(cookie *Cookie) error {
+	if err := cookie.validate(); err != nil {
+		return err
+	}
+	if wr.wroteHeader {
+		return errHeadersWritten
+	}
+	wr.WriteOtherHeader("Set-Cookie", string(appendCookie(nil, cookie)))
+	return nil
+}
+
+func (wr *fromHTTPResponseWriter) writeHeader() {
+	if wr.wroteHeader {
+		return
+	}
+	wr.WriteStatus(200)
+	wr.wroteHeader = true
+	wr.w.WriteHeader(wr.statusCode)
+}
+
+func (wr *fromHTTPResponseWriter) Write(data []byte) (int, error) {
+	wr.writeHeader()
+	return wr.w.Write(data)
+}
+
+func (wr *fromHTTPResponseWriter) Flush() error {
+	wr.writeHeader()
+	return http.NewResponseController(wr.w).Flush()
+}
+
+func (wr *fromHTTPResponseWriter) Hijack() (net.Conn, []byte, []byte, error) {
+	conn, rw, err := http.NewResponseController(wr.w).Hijack()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	wr.hijacked = true
+	incoming, _ := rw.Reader.Peek(rw.Reader.Buffered())
+	incoming = append([]byte(nil), incoming...)
+	return conn, incoming, nil, rw.Writer.Flush()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testHTTPMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Q", r.URL.Query().Get("q"))
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.Path, r.Header.Get("X-Foo"), b)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "part%d;", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("x", 100000)))
+	})
+	return mux
+}
+
+func TestFromHTTPHandlerBodies(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: FromHTTPHandler(testHTTPMux())}))
+	resp, body := roundTrip(t, conn, "POST /echo?q=1 HTTP/1.1\r\nX-Foo: bar\r\nContent-Length: 5\r\n\r\nhello")
+	if body != "POST /echo bar hello" || resp.Header.Get("X-Q") != "1" {
+		t.Fatal(body, resp.Header)
+	}
+	_, body = roundTrip(t, conn, "POST /echo HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2;x=y\r\nde\r\n0\r\n\r\n")
+	if body != "POST /echo  abcde" {
+		t.Fatal(body)
+	}
+	// Unread body is discarded, flushed response is chunked
+	resp, body = roundTrip(t, conn, "POST /stream HTTP/1.1\r\nContent-Length: 3\r\n\r\nxyz")
+	if body != "part0;part1;part2;" || len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatal(body, resp.TransferEncoding)
+	}
+	if _, body = roundTrip(t, conn, "GET /big HTTP/1.1\r\n\r\n"); len(body) != 100000 {
+		t.Fatal(len(body))
+	}
+	if resp, _ = roundTrip(t, conn, "GET /nope HTTP/1.1\r\n\r\n"); resp.StatusCode != 404 {
+		t.Fatal(resp.StatusCode)
+	}
+}
+
+func TestFromHTTPHandlerExpectContinue(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: FromHTTPHandler(testHTTPMux())}))
+	_, _ = io.WriteString(conn, "POST /echo HTTP/1.1\r\nExpect: 100-Continue\r\nContent-Length: 2\r\n\r\n")
+	br := bufio.NewReader(conn)
+	if line, _ := br.ReadString('\n'); line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("%q", line)
+	}
+	_, _ = br.ReadString('\n')
+	_, _ = io.WriteString(conn, "hi")
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(resp.Body); string(b) != "POST /echo  hi" {
+		t.Fatal(string(b))
+	}
+}
+
+func TestFromHTTPHandlerHTTP10CloseDelimited(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: FromHTTPHandler(testHTTPMux())}))
+	_, _ = io.WriteString(conn, "GET /stream HTTP/1.0\r\n\r\n")
+	all, _ := io.ReadAll(conn)
+	if !strings.HasSuffix(string(all), "\r\n\r\npart0;part1;part2;") || strings.Contains(string(all), "chunked") {
+		t.Fatalf("%q", all)
+	}
+}
+
+func TestToHTTPHandler(t *testing.T) {
+	srv := httptest.NewServer(ToHTTPHandler(func(wr ResponseWriter, r *Request) {
+		b, _ := io.ReadAll(r.Body())
+		wr.WriteStatus(201)
+		wr.WriteOtherHeader("x-mime", string(r.ContentTypeMime)+"|"+string(r.ContentTypeSuffix))
+		wr.WriteOtherHeader("x-h", string(r.HeaderLower("x-foo"))+"|"+string(r.Host)+"|"+string(r.QueryString)+"|"+r.ClientIP().String())
+		_, _ = wr.Write([]byte(string(r.Method) + " " + string(r.Path) + " " + string(b)))
+	}))
+	defer srv.Close()
+	req, _ := http.NewRequest("PUT", srv.URL+"/a%20b?x=1", strings.NewReader("data"))
+	req.Header.Set("X-Foo", "bar")
+	req.Header.Set("Content-Type", "Text/Plain;charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 201 || string(b) != "PUT /a b data" {
+		t.Fatal(resp.StatusCode, string(b))
+	}
+	if resp.Header.Get("x-mime") != "text/plain|charset=utf-8" || resp.Header.Get("x-h") != "bar|"+srv.Listener.Addr().String()+"|x=1|127.0.0.1" {
+		t.Fatal(resp.Header)
+	}
+}
+
+func TestToHTTPHandlerStreamsWithoutContentLength(t *testing.T) {
+	srv := httptest.NewServer(ToHTTPHandler(func(wr ResponseWriter, r *Request) {
+		for i := 0; i < 3; i++ {
+			_, _ = wr.Write([]byte(strings.Repeat("y", 10000)))
+		}
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != 200 || len(b) != 30000 {
+		t.Fatal(resp.StatusCode, len(b))
+	}
+}
+
+func TestFromHTTPHandlerHijack(t *testing.T) {
+	mux := testHTTPMux()
+	mux.HandleFunc("/hijack", func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := rw.ReadString('\n')
+		_, _ = conn.Write([]byte("echo:" + line))
+	})
+	conn := dial(t, startServer(t, &Server{handler: FromHTTPHandler(mux)}))
+	roundTrip(t, conn, "GET /echo HTTP/1.1\r\n\r\n")
+	_, _ = io.WriteString(conn, "GET /hijack HTTP/1.1\r\n\r\nline1\n")
+	if rest, _ := io.ReadAll(conn); string(rest) != "echo:line1\n" {
+		t.Fatalf("%q", rest)
+	}
+}
+
+func TestToHTTPHandlerHijack(t *testing.T) {
+	srv := httptest.NewServer(ToHTTPHandler(func(wr ResponseWriter, r *Request) {
+		conn, incoming, outgoing, err := wr.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(outgoing)
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n\r\n[" + string(incoming) + "]"))
+	}))
+	defer srv.Close()
+	conn := dial(t, srv.Listener.Addr().String())
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\nearly")
+	want := "HTTP/1.1 101 Switching Protocols\r\n\r\n[early]"
+	b := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != want {
+		t.Fatalf("%q %v", b, err)
+	}
+}
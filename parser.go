@@ -83,7 +83,7 @@ func fromHexDigit(c byte) int {
 }
 
 func parseContentTypeValue(value []byte) ([]byte, []byte) { // lowercase mime, suffix
-	start := bytes.Index(value, []byte{';', ' ', '\t'})
+	start := bytes.IndexAny(value, "; \t")
 	if start < 0 {
 		toTowerSlice(value)
 		return value, nil
@@ -522,17 +522,27 @@ func (c *Client) consume(incomingBuffer []byte, incomingReadPos int, state int)
 	return BAD
 }
 */
+// isCMSListHeader tells if header value is a comma-separated list we split into tokens while parsing
+func isCMSListHeader(key []byte) bool {
+	return string(key) == "connection" || string(key) == "transfer-encoding" || string(key) == "upgrade"
+}
+
 func (c *Client) processReadyHeader(key []byte, value []byte) bool {
 	// We have no backtracking, so cheat here
 	for len(value) != 0 && isSP(value[len(value)-1]) {
 		value = value[:len(value)-1]
 	}
+	for len(value) != 0 && isSP(value[0]) { // After ',' in CMS list
+		value = value[1:]
+	}
 	if c.headerCMSList && len(value) == 0 {
 		return true // Empty is NOP in CMS list, like "  ,,keep-alive"
 	}
-	// Those comparisons are by size first so very fast
 	r := &c.request
-	if string(key) == "content-length" {
+	table := c.headerTable()
+	id := table.lookup(key)
+	switch id {
+	case HEADER_CONTENT_LENGTH:
 		if r.ContentLength >= 0 {
 			c.parseError = "content length specified more than once"
 			return false
@@ -544,37 +554,33 @@ func (c *Client) processReadyHeader(key []byte, value []byte) bool {
 		}
 		r.ContentLength = cl
 		return true
-	}
-	if string(key) == "transfer-encoding" {
+	case HEADER_TRANSFER_ENCODING:
 		toTowerSlice(value)
+		if r.TransferEncodingChunked {
+			c.parseError = "chunk encoding must be applied last"
+			return false
+		}
 		if string(value) == "chunked" {
-			if len(r.TransferEncodings) != 0 {
-				c.parseError = "chunk encoding must be applied last"
-				return false
-			}
 			r.TransferEncodingChunked = true
 			return true
 		}
 		if string(value) == "identity" {
 			return true // like chunked, it is transparent to user
 		}
-		r.TransferEncodings = append(r.TransferEncodings, value)
+		r.TransferEncodings = append(r.TransferEncodings, value) // Decoded by Request.Body
 		return true
-	}
-	if string(key) == "host" {
+	case HEADER_HOST:
 		r.Host = value
 		return true
-	}
-	if string(key) == "origin" {
+	case HEADER_ORIGIN:
 		r.Origin = value
 		return true
-	}
-	if string(key) == "content-type" {
+	case HEADER_CONTENT_TYPE:
 		r.ContentTypeMime, r.ContentTypeSuffix = parseContentTypeValue(value)
 		return true
-	}
-	if string(key) == "connection" {
+	case HEADER_CONNECTION:
 		toTowerSlice(value)
+		r.ConnectionTokens = append(r.ConnectionTokens, value)
 		if string(value) == "close" {
 			r.KeepAlive = false
 			return true
@@ -587,30 +593,51 @@ func (c *Client) processReadyHeader(key []byte, value []byte) bool {
 			r.ConnectionUpgrade = true
 			return true
 		}
-		c.parseError = "Invalid 'connection' header value"
-		return false
-	}
-	if string(key) == "authorization" {
-		r.BasicAuthorization = parseAuthorizationBasic(value)
-		return true
-	}
-	if string(key) == "upgrade" {
+		return true // Other tokens name hop-by-hop headers, see stripHopByHopHeaders
+	case HEADER_AUTHORIZATION:
+		if r.BasicAuthorization = parseAuthorizationBasic(value); r.BasicAuthorization != nil {
+			return true
+		}
+		// Other schemes stay in Headers, so handlers and proxies can see them
+	case HEADER_UPGRADE:
 		toTowerSlice(value)
+		r.UpgradeProtocols = append(r.UpgradeProtocols, value)
 		if string(value) == "websocket" {
 			r.UpgradeWebSocket = true
-			return true
 		}
-		c.parseError = "Invalid 'upgrade' header value"
-		return false
-	}
-	if string(key) == "sec-websocket-key" {
+		return true
+	case HEADER_SEC_WEBSOCKET_KEY:
 		r.SecWebsocketKey = value
 		return true
-	}
-	if string(key) == "sec-websocket-version" {
+	case HEADER_SEC_WEBSOCKET_VERSION:
 		r.SecWebsocketVersion = value
 		return true
 	}
-	r.Headers = append(r.Headers, HeaderKV{key: key, value: value})
+	r.Headers = append(r.Headers, HeaderKV{id: id, key: key, value: value})
+	r.headerTable = table
 	return true
 }
+
+// stripHopByHopHeaders moves headers named in connection header from Headers to HopByHopHeaders,
+// so they are not forwarded by proxies, but still available to upgrade handlers (like http2-settings)
+func (r *Request) stripHopByHopHeaders() {
+	if len(r.ConnectionTokens) == 0 {
+		return
+	}
+	headers := r.Headers[:0]
+	for _, kv := range r.Headers {
+		hop := false
+		for _, token := range r.ConnectionTokens {
+			if string(kv.key) == string(token) {
+				hop = true
+				break
+			}
+		}
+		if hop {
+			r.HopByHopHeaders = append(r.HopByHopHeaders, kv)
+		} else {
+			headers = append(headers, kv)
+		}
+	}
+	r.Headers = headers
+}
@@ -1,7 +1,5 @@
 package main
 
-import "log"
-
 func expectChar(ib []byte, pos *int, c byte) bool {
 	if ib[*pos] != c {
 		return false
@@ -76,7 +74,7 @@ func (c *Client) parseURIShifted(ib []byte, pos *int, uriStart int) bool { // po
 	ib[uriWritePos] = byte(digit1*16 + digit2)
 	uriWritePos += 1
 
-	for ; ; (*pos)++ {
+	for {
 		input := ib[*pos]
 		if isSP(input) {
 			c.request.Path = ib[uriStart:uriWritePos]
@@ -102,15 +100,35 @@ func (c *Client) parseURIShifted(ib []byte, pos *int, uriStart int) bool { // po
 			(*pos) += 3
 			ib[uriWritePos] = byte(digit1*16 + digit2)
 			uriWritePos += 1
+			continue
 		}
 		if isCTL(input) {
 			return false
 		}
+		ib[uriWritePos] = input // Shift left over consumed escapes
+		uriWritePos++
+		(*pos)++
 	}
 }
 
+// keepRawTarget sets RawTarget, copying it only if decoding of Path or Args would change it
+func (c *Client) keepRawTarget(ib []byte, start int) {
+	end := start
+	escaped := false
+	for ; !isSP(ib[end]) && ib[end] != '#' && !isCTL(ib[end]); end++ {
+		escaped = escaped || ib[end] == '%' || ib[end] == '+'
+	}
+	if !escaped {
+		c.request.RawTarget = ib[start:end]
+		return
+	}
+	c.rawTargetBuffer = append(c.rawTargetBuffer[:0], ib[start:end]...)
+	c.request.RawTarget = c.rawTargetBuffer
+}
+
 func (c *Client) parseURI(ib []byte, pos *int) bool {
 	uriStart := *pos
+	c.keepRawTarget(ib, uriStart)
 	input := ib[*pos]
 	if input == '#' {
 		//c.parseError = "Invalid '#' character at uri start"
@@ -197,6 +215,7 @@ func (c *Client) parseHeaderKey(ib []byte, pos *int, headerKeyFinish *int) bool
 		if isBad(input) {
 			return false
 		}
+		ib[*pos] = toLower(input) // So processReadyHeader and lookups can compare with lowercase names
 	}
 }
 
@@ -278,6 +297,7 @@ func (c *Client) parseHeaders(ib []byte, pos *int) bool {
 	if !c.parseHeaderKey(ib, pos, &headerKeyFinish) {
 		return false
 	}
+	c.headerCMSList = isCMSListHeader(ib[headerKeyStart:headerKeyFinish])
 	skipSP(ib, pos)
 	headerValueStart := 0
 	headerValueWritePos := 0
@@ -299,7 +319,7 @@ func (c *Client) parseHeaders(ib []byte, pos *int) bool {
 	for {
 		input := ib[*pos]
 		if isSP(input) { // value continuation
-			log.Fatal("Value Cont not yet supported")
+			return false // Obsolete line folding, rejecting it is allowed by RFC 7230
 			/*			ib[headerValueWritePos] = input
 						headerValueWritePos++
 						for {
@@ -336,6 +356,7 @@ func (c *Client) parseHeaders(ib []byte, pos *int) bool {
 		if !c.parseHeaderKey(ib, pos, &headerKeyFinish) {
 			return false
 		}
+		c.headerCMSList = isCMSListHeader(ib[headerKeyStart:headerKeyFinish])
 
 		skipSP(ib, pos)
 		for {
@@ -385,3 +406,45 @@ func (c *Client) parse2() string {
 	c.incomingReadPos = pos
 	return ""
 }
+
+// parseResponse2 parses status line into resp, headers go to c.request like for requests
+func (c *Client) parseResponse2(resp *Response) string {
+	ib := c.incomingBuffer
+	pos := c.incomingReadPos
+	if ib[pos] != 'H' || ib[pos+1] != 'T' || ib[pos+2] != 'T' || ib[pos+3] != 'P' || ib[pos+4] != '/' || ib[pos+5] != '1' || ib[pos+6] != '.' {
+		return "error"
+	}
+	pos += 7
+	if !isDigit(ib[pos]) || !isSP(ib[pos+1]) {
+		return "error"
+	}
+	c.request.VersionMajor = 1
+	c.request.VersionMinor = int(ib[pos] - '0')
+	c.request.KeepAlive = c.request.VersionMinor >= 1
+	pos++
+	skipSP(ib, &pos)
+	if !isDigit(ib[pos]) || !isDigit(ib[pos+1]) || !isDigit(ib[pos+2]) {
+		return "error"
+	}
+	resp.StatusCode = int(ib[pos]-'0')*100 + int(ib[pos+1]-'0')*10 + int(ib[pos+2]-'0')
+	pos += 3
+	skipSP(ib, &pos)
+	reasonStart := pos
+	for ; ib[pos] != '\r' && ib[pos] != '\n'; pos++ {
+		if isCTL(ib[pos]) && ib[pos] != '\t' {
+			return "error"
+		}
+	}
+	resp.Reason = ib[reasonStart:pos]
+	if ib[pos] == '\r' {
+		pos++
+	}
+	if !expectChar(ib, &pos, '\n') {
+		return "error"
+	}
+	if !c.parseHeaders(ib, &pos) {
+		return "error"
+	}
+	c.incomingReadPos = pos
+	return ""
+}
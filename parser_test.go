@@ -1,5 +1,10 @@
 package main
 
+import (
+	"strings"
+	"testing"
+)
+
 // TODO - lots of tests
 
 /*
@@ -26,3 +31,117 @@ package main
 		log.Fatalf("Error %v", err)
 	}
 */
+
+// Headers of typical browser request, in lowercase as parser leaves them
+var benchHeaderKeys = [][]byte{
+	[]byte("host"), []byte("user-agent"), []byte("accept"), []byte("accept-language"),
+	[]byte("accept-encoding"), []byte("referer"), []byte("connection"), []byte("cookie"),
+	[]byte("upgrade-insecure-requests"), []byte("sec-fetch-dest"), []byte("sec-fetch-mode"),
+	[]byte("sec-fetch-site"), []byte("if-modified-since"), []byte("if-none-match"),
+	[]byte("cache-control"), []byte("content-type"), []byte("content-length"),
+}
+
+// headerChainID is dispatch of processReadyHeader before header IDs, for comparison
+func headerChainID(key []byte) HeaderID {
+	if string(key) == "content-length" {
+		return HEADER_CONTENT_LENGTH
+	}
+	if string(key) == "transfer-encoding" {
+		return HEADER_TRANSFER_ENCODING
+	}
+	if string(key) == "host" {
+		return HEADER_HOST
+	}
+	if string(key) == "origin" {
+		return HEADER_ORIGIN
+	}
+	if string(key) == "content-type" {
+		return HEADER_CONTENT_TYPE
+	}
+	if string(key) == "connection" {
+		return HEADER_CONNECTION
+	}
+	if string(key) == "authorization" {
+		return HEADER_AUTHORIZATION
+	}
+	if string(key) == "upgrade" {
+		return HEADER_UPGRADE
+	}
+	if string(key) == "sec-websocket-key" {
+		return HEADER_SEC_WEBSOCKET_KEY
+	}
+	if string(key) == "sec-websocket-version" {
+		return HEADER_SEC_WEBSOCKET_VERSION
+	}
+	return HEADER_UNKNOWN
+}
+
+func BenchmarkHeaderDispatchChain(b *testing.B) {
+	var sum HeaderID
+	for i := 0; i < b.N; i++ {
+		for _, key := range benchHeaderKeys {
+			sum += headerChainID(key)
+		}
+	}
+	benchSink = int(sum)
+}
+
+func BenchmarkHeaderDispatchHash(b *testing.B) {
+	var sum HeaderID
+	for i := 0; i < b.N; i++ {
+		for _, key := range benchHeaderKeys {
+			sum += defaultHeaderTable.lookup(key)
+		}
+	}
+	benchSink = int(sum)
+}
+
+// Lookup of well-known header by name, the chain had no equivalent but scanning Headers
+func BenchmarkHeaderLookupByName(b *testing.B) {
+	r := benchRequest(b)
+	for i := 0; i < b.N; i++ {
+		benchSink += len(r.HeaderLower("if-none-match"))
+	}
+}
+
+func BenchmarkHeaderLookupByID(b *testing.B) {
+	r := benchRequest(b)
+	for i := 0; i < b.N; i++ {
+		benchSink += len(r.HeaderByID(HEADER_IF_NONE_MATCH))
+	}
+}
+
+func BenchmarkParseRequest(b *testing.B) {
+	request := benchRequestText()
+	c := Client{incomingBuffer: make([]byte, len(request)+eofheaderGuardSize)}
+	b.SetBytes(int64(len(request)))
+	for i := 0; i < b.N; i++ {
+		copy(c.incomingBuffer, request) // Parser modifies buffer in place
+		c.incomingReadPos = 0
+		c.request.ContentLength = -1
+		c.request.Headers = c.request.Headers[:0]
+		c.request.ConnectionTokens = c.request.ConnectionTokens[:0]
+		if str := c.parse2(); str != "" {
+			b.Fatal(str)
+		}
+	}
+}
+
+var benchSink int
+
+func benchRequestText() []byte {
+	text := "GET /static/app.js?v=3 HTTP/1.1\r\n"
+	for _, key := range benchHeaderKeys {
+		text += string(key) + ": value\r\n"
+	}
+	return []byte(strings.Replace(text+"\r\n", "content-length: value", "content-length: 0", 1))
+}
+
+func benchRequest(b *testing.B) *Request {
+	c := Client{incomingBuffer: append(benchRequestText(), 0, 0)}
+	c.request.ContentLength = -1
+	if str := c.parse2(); str != "" {
+		b.Fatal(str)
+	}
+	return &c.request
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BALANCE_ROUND_ROBIN = iota
+	BALANCE_LEAST_CONN  = iota
+)
+
+const defaultProxyRetries = 2
+const defaultHealthCheckInterval = 5 * time.Second
+const healthCheckTimeout = 2 * time.Second
+const proxyCopyBufferSize = 32 * 1024
+
+// Upstream is a backend server of ReverseProxy
+type Upstream struct {
+	Addr string // host:port
+
+	active    int64 // Requests in flight, atomic
+	unhealthy int32 // Set by health checks and failed requests, atomic
+}
+
+func (u *Upstream) Healthy() bool         { return atomic.LoadInt32(&u.unhealthy) == 0 }
+func (u *Upstream) ActiveRequests() int64 { return atomic.LoadInt64(&u.active) }
+
+// ReverseProxy forwards requests to a pool of upstreams, use Serve as Handler.
+// Request and response bodies are streamed, not buffered.
+type ReverseProxy struct {
+	Upstreams    []*Upstream
+	Balance      int         // BALANCE_ROUND_ROBIN or BALANCE_LEAST_CONN
+	Client       *HTTPClient // nil means a client with default settings
+	PreserveHost bool        // Send client host header instead of upstream address
+	Retries      int         // Attempts on other upstreams for idempotent requests without body, 0 means defaultProxyRetries, -1 none
+
+	// Active health checks, see StartHealthChecks
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration // 0 means defaultHealthCheckInterval
+
+	next           uint32 // Round-robin position, atomic
+	clientOnce     sync.Once
+	client         *HTTPClient
+	healthChecking int32 // atomic
+	stopOnce       sync.Once
+	stop           chan struct{}
+}
+
+func NewReverseProxy(addrs ...string) *ReverseProxy {
+	p := &ReverseProxy{}
+	for _, addr := range addrs {
+		p.Upstreams = append(p.Upstreams, &Upstream{Addr: addr})
+	}
+	return p
+}
+
+var proxyCopyBuffers = sync.Pool{New: func() interface{} { return make([]byte, proxyCopyBufferSize) }}
+
+// isProxyHopByHop tells if header is for one connection and must not be forwarded.
+// Headers named in connection header are already moved to Request.HopByHopHeaders by parser.
+func isProxyHopByHop(key []byte) bool {
+	switch string(key) {
+	case "connection", "keep-alive", "proxy-connection", "proxy-authenticate", "proxy-authorization",
+		"te", "trailer", "transfer-encoding", "upgrade":
+		return true
+	}
+	return false
+}
+
+func (p *ReverseProxy) httpClient() *HTTPClient {
+	if p.Client != nil {
+		return p.Client
+	}
+	p.clientOnce.Do(func() { p.client = &HTTPClient{} })
+	return p.client
+}
+
+// pick selects healthy upstream not in tried, nil if none
+func (p *ReverseProxy) pick(tried []*Upstream) *Upstream {
+	n := len(p.Upstreams)
+	if n == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint32(&p.next, 1) % uint32(n))
+	var best *Upstream
+	for i := 0; i < n; i++ {
+		u := p.Upstreams[(start+i)%n]
+		if !u.Healthy() || containsUpstream(tried, u) {
+			continue
+		}
+		if p.Balance != BALANCE_LEAST_CONN {
+			return u
+		}
+		if best == nil || u.ActiveRequests() < best.ActiveRequests() {
+			best = u
+		}
+	}
+	return best
+}
+
+func containsUpstream(upstreams []*Upstream, u *Upstream) bool {
+	for _, v := range upstreams {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve forwards request to upstream and streams response back.
+// Answers 502 if upstream failed before response started, aborts connection if after.
+func (p *ReverseProxy) Serve(wr ResponseWriter, r *Request) {
+	req := p.newClientRequest(r)
+	retries := p.Retries
+	if retries == 0 {
+		retries = defaultProxyRetries
+	}
+	if req.Body != nil || !isIdempotent(req.Method) {
+		retries = 0 // Body is consumed by the first attempt
+	}
+	var triedScratch [4]*Upstream
+	tried := triedScratch[:0]
+	for attempt := 0; ; attempt++ {
+		u := p.pick(tried)
+		if u == nil {
+			if len(tried) == 0 {
+				writeSimpleResponse(wr, 503, "")
+			} else {
+				writeSimpleResponse(wr, 502, "")
+			}
+			return
+		}
+		tried = append(tried, u)
+		req.Addr = u.Addr
+		if !p.PreserveHost {
+			req.Host = u.Addr
+		}
+		atomic.AddInt64(&u.active, 1)
+		resp, err := p.httpClient().Do(req)
+		if err != nil {
+			atomic.AddInt64(&u.active, -1)
+			if atomic.LoadInt32(&p.healthChecking) != 0 { // Health checks will bring it back
+				atomic.StoreInt32(&u.unhealthy, 1)
+			}
+			if attempt < retries {
+				continue
+			}
+			writeSimpleResponse(wr, 502, "")
+			return
+		}
+		err = copyResponse(wr, resp, req.Method == "HEAD")
+		_ = resp.Close()
+		atomic.AddInt64(&u.active, -1)
+		if err != nil {
+			panic(http.ErrAbortHandler) // Response is partially sent, client must see connection abort
+		}
+		return
+	}
+}
+
+// newClientRequest copies request headers without copying bytes, they live while handler runs
+func (p *ReverseProxy) newClientRequest(r *Request) *ClientRequest {
+	// Decoding is not reversible, %2F and '/' are different to upstream, so target is forwarded as received
+	req := &ClientRequest{Method: string(r.Method), Path: string(r.RawTarget)}
+	if p.PreserveHost {
+		req.Host = string(r.Host)
+	}
+	var forwarded []byte
+	for _, kv := range r.Headers {
+		if string(kv.key) == "forwarded" {
+			forwarded = append(append(forwarded, kv.value...), ", "...)
+			continue
+		}
+		if !isProxyHopByHop(kv.key) {
+			req.headers = append(req.headers, kv)
+		}
+	}
+	// Fields parsed by processReadyHeader are not in r.Headers
+	if len(r.Origin) != 0 {
+		req.headers = append(req.headers, HeaderKV{key: []byte("origin"), value: r.Origin})
+	}
+	if len(r.ContentTypeMime) != 0 {
+		contentType := r.ContentTypeMime
+		if len(r.ContentTypeSuffix) != 0 {
+			contentType = append(append(append([]byte{}, contentType...), "; "...), r.ContentTypeSuffix...)
+		}
+		req.headers = append(req.headers, HeaderKV{key: []byte("content-type"), value: contentType})
+	}
+	if len(r.BasicAuthorization) != 0 {
+		req.headers = append(req.headers, HeaderKV{key: []byte("authorization"), value: append([]byte("Basic "), r.BasicAuthorization...)})
+	}
+	forwarded = appendForwarded(forwarded, r)
+	req.headers = append(req.headers, HeaderKV{key: []byte("forwarded"), value: forwarded})
+	switch {
+	case r.TransferEncodingChunked:
+		req.Body = r.RawBody()
+	case r.ContentLength > 0:
+		req.Body = r.RawBody()
+		req.ContentLength = r.ContentLength
+	}
+	return req
+}
+
+// appendForwarded appends our element of forwarded header, RFC 7239
+func appendForwarded(b []byte, r *Request) []byte {
+	b = append(b, "for="...)
+	if ip := addrIP(r.RemoteAddr); !ip.IsValid() {
+		b = append(b, "unknown"...)
+	} else if ip.Is6() {
+		b = append(b, `"[`...)
+		b = ip.AppendTo(b)
+		b = append(b, `]"`...)
+	} else {
+		b = ip.AppendTo(b)
+	}
+	if len(r.Host) != 0 && validRequestString(string(r.Host)) && bytes.IndexByte(r.Host, '"') < 0 {
+		b = append(b, `;host="`...)
+		b = append(b, r.Host...)
+		b = append(b, '"')
+	}
+	if r.TLS != nil {
+		return append(b, ";proto=https"...)
+	}
+	return append(b, ";proto=http"...)
+}
+
+// copyResponse streams upstream response to wr, flushing as data arrives if length is unknown
+func copyResponse(wr ResponseWriter, resp *Response, head bool) error {
+	wr.WriteStatus(resp.StatusCode)
+	for _, kv := range resp.Headers {
+		if isProxyHopByHop(kv.key) {
+			continue
+		}
+		switch string(kv.key) {
+		case "date":
+			wr.WriteDate(string(kv.value))
+		case "server":
+			wr.WriteServer(string(kv.value))
+		default:
+			wr.WriteOtherHeader(string(kv.key), string(kv.value))
+		}
+	}
+	if len(resp.ContentTypeMime) != 0 {
+		contentType := string(resp.ContentTypeMime)
+		if len(resp.ContentTypeSuffix) != 0 {
+			contentType += "; " + string(resp.ContentTypeSuffix)
+		}
+		wr.WriteOtherHeader("content-type", contentType)
+	}
+	streaming := resp.ContentLength < 0 || resp.TransferEncodingChunked
+	if !streaming { // Also for HEAD, where it is the size of resource, and server sends no body
+		wr.WriteContentLength(resp.ContentLength)
+	}
+	if head || statusWithoutBody(resp.StatusCode) {
+		return nil
+	}
+	buf := proxyCopyBuffers.Get().([]byte)
+	defer proxyCopyBuffers.Put(buf)
+	body := resp.Body()
+	for {
+		n, err := body.Read(buf)
+		if n != 0 {
+			if _, err := wr.Write(buf[:n]); err != nil {
+				return err
+			}
+			if streaming {
+				if err := wr.Flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// StartHealthChecks probes HealthCheckPath of every upstream periodically until Close.
+// Upstream is healthy if it answers with status below 500. Must be called once, before Serve.
+func (p *ReverseProxy) StartHealthChecks() {
+	p.stop = make(chan struct{})
+	atomic.StoreInt32(&p.healthChecking, 1)
+	interval := p.HealthCheckInterval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	client := &HTTPClient{DialTimeout: healthCheckTimeout, Timeout: healthCheckTimeout, MaxIdleConnsPerHost: 1}
+	p.checkHealth(client)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer client.CloseIdleConnections()
+		for {
+			select {
+			case <-ticker.C:
+				p.checkHealth(client)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *ReverseProxy) checkHealth(client *HTTPClient) {
+	var wg sync.WaitGroup
+	for _, u := range p.Upstreams {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			healthy := false
+			resp, err := client.Do(&ClientRequest{Addr: u.Addr, Path: p.HealthCheckPath})
+			if err == nil {
+				healthy = resp.StatusCode < 500
+				_ = resp.Close()
+			}
+			if healthy {
+				atomic.StoreInt32(&u.unhealthy, 0)
+			} else {
+				atomic.StoreInt32(&u.unhealthy, 1)
+			}
+		}(u)
+	}
+	wg.Wait()
+}
+
+// Close stops health checks and closes idle upstream connections of default client
+func (p *ReverseProxy) Close() {
+	p.stopOnce.Do(func() {
+		if p.stop != nil {
+			close(p.stop)
+		}
+	})
+	if p.Client == nil {
+		p.httpClient().CloseIdleConnections()
+	}
+}
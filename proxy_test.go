@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyUpstream answers with its name and what it received, request-target as sent by proxy
+func proxyUpstream(t *testing.T, name string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if r.URL.Path == "/stream" {
+			_, _ = w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+			_, _ = w.Write([]byte("b"))
+			return
+		}
+		fmt.Fprintf(w, "%s|%s|%s|%s|%s|%s|%s|%s", name, r.Method, r.RequestURI, r.Host, r.Header.Get("Forwarded"), r.Header.Get("X-Secret"), r.Header.Get("Authorization"), b)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func deadAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+func startProxy(t *testing.T, p *ReverseProxy, middlewares ...Middleware) net.Conn {
+	t.Cleanup(p.Close)
+	return dial(t, startServer(t, &Server{handler: Chain(p.Serve, middlewares...)}))
+}
+
+func TestReverseProxyForwardsRawTarget(t *testing.T) {
+	up := proxyUpstream(t, "a")
+	// Handler before proxy decodes query in place
+	readArgs := func(next Handler) Handler {
+		return func(wr ResponseWriter, r *Request) {
+			if string(r.Args().Peek("x")) != "&y z" {
+				t.Errorf("%q", r.Args().Peek("x"))
+			}
+			next(wr, r)
+		}
+	}
+	conn := startProxy(t, NewReverseProxy(up.Listener.Addr().String()), readArgs)
+	for _, target := range []string{"/a%2Fb/c%20d?x=%26y+z", "/plain/a+b?x=%26y%20z&q"} {
+		_, body := roundTrip(t, conn, "GET "+target+" HTTP/1.1\r\nHost: front\r\n\r\n")
+		if parts := strings.Split(body, "|"); len(parts) < 3 || parts[2] != target {
+			t.Errorf("%s: %q", target, body)
+		}
+	}
+}
+
+func TestReverseProxyHeaders(t *testing.T) {
+	up := proxyUpstream(t, "a")
+	conn := startProxy(t, NewReverseProxy(up.Listener.Addr().String()))
+	resp, body := roundTrip(t, conn, "GET / HTTP/1.1\r\nHost: front\r\nConnection: X-Secret\r\nX-Secret: s\r\nAuthorization: Bearer tok\r\n\r\n")
+	if resp.StatusCode != 200 || resp.Header.Get("Keep-Alive") != "" || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatal(resp.Status, resp.Header)
+	}
+	want := fmt.Sprintf(`a|GET|/|%s|for=127.0.0.1;host="front";proto=http||Bearer tok|`, up.Listener.Addr())
+	if body != want {
+		t.Fatalf("got %q, want %q", body, want)
+	}
+	_, body = roundTrip(t, conn, "POST /p HTTP/1.1\r\nHost: front\r\nForwarded: for=1.2.3.4\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n")
+	if !strings.HasSuffix(body, `|for=1.2.3.4, for=127.0.0.1;host="front";proto=http|||abc`) {
+		t.Fatal(body)
+	}
+	resp, body = roundTrip(t, conn, "GET /stream HTTP/1.1\r\nHost: front\r\n\r\n")
+	if body != "ab" || len(resp.TransferEncoding) == 0 {
+		t.Fatal(body, resp.TransferEncoding)
+	}
+}
+
+func TestReverseProxyPreserveHost(t *testing.T) {
+	up := proxyUpstream(t, "a")
+	p := NewReverseProxy(up.Listener.Addr().String())
+	p.PreserveHost = true
+	if _, body := roundTrip(t, startProxy(t, p), "GET / HTTP/1.1\r\nHost: front\r\n\r\n"); !strings.HasPrefix(body, "a|GET|/|front|") {
+		t.Fatal(body)
+	}
+}
+
+func TestReverseProxyBalanceAndRetry(t *testing.T) {
+	a, b := proxyUpstream(t, "a"), proxyUpstream(t, "b")
+	conn := startProxy(t, NewReverseProxy(a.Listener.Addr().String(), b.Listener.Addr().String(), deadAddr(t)))
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ { // Requests to dead upstream are retried on the next one
+		resp, body := roundTrip(t, conn, "GET / HTTP/1.1\r\nHost: front\r\n\r\n")
+		if resp.StatusCode != 200 {
+			t.Fatal(resp.Status, body)
+		}
+		seen[body[:1]]++
+	}
+	if seen["a"]+seen["b"] != 6 || seen["a"] < 2 || seen["b"] < 2 {
+		t.Fatal(seen)
+	}
+}
+
+func TestReverseProxyHealthChecks(t *testing.T) {
+	a, b := proxyUpstream(t, "a"), proxyUpstream(t, "b")
+	p := NewReverseProxy(a.Listener.Addr().String(), b.Listener.Addr().String(), deadAddr(t))
+	p.HealthCheckPath = "/health"
+	p.HealthCheckInterval = time.Hour // Checked explicitly below
+	p.StartHealthChecks()
+	conn := startProxy(t, p)
+	if !p.Upstreams[0].Healthy() || !p.Upstreams[1].Healthy() || p.Upstreams[2].Healthy() {
+		t.Fatal("initial check")
+	}
+	for i := 0; i < 4; i++ { // Requests with body are not retried, so they must go to healthy upstreams only
+		if resp, body := roundTrip(t, conn, "POST /p HTTP/1.1\r\nHost: front\r\nContent-Length: 1\r\n\r\nz"); resp.StatusCode != 200 {
+			t.Fatal(resp.Status, body)
+		}
+	}
+	b.Close()
+	p.checkHealth(&HTTPClient{Timeout: time.Second})
+	p.Balance = BALANCE_LEAST_CONN
+	if resp, body := roundTrip(t, conn, "GET / HTTP/1.1\r\nHost: front\r\n\r\n"); resp.StatusCode != 200 || !strings.HasPrefix(body, "a|") {
+		t.Fatal(resp.Status, body)
+	}
+	a.Close()
+	p.checkHealth(&HTTPClient{Timeout: time.Second})
+	if resp, _ := roundTrip(t, conn, "GET / HTTP/1.1\r\nHost: front\r\n\r\n"); resp.StatusCode != 503 {
+		t.Fatal(resp.Status)
+	}
+}
+
+// HEAD response has no body, but its content-length is the size GET would return
+func TestReverseProxyHead(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1234")
+		if r.Method != "HEAD" {
+			_, _ = w.Write(make([]byte, 1234))
+		}
+	}))
+	t.Cleanup(up.Close)
+	conn := startProxy(t, NewReverseProxy(up.Listener.Addr().String()))
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ { // Connection stays usable, so no body was sent
+		_, _ = io.WriteString(conn, "HEAD /file HTTP/1.1\r\nHost: front\r\n\r\n")
+		resp, err := http.ReadResponse(br, &http.Request{Method: "HEAD"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || resp.ContentLength != 1234 {
+			t.Fatalf("%d, length %d", resp.StatusCode, resp.ContentLength)
+		}
+	}
+}
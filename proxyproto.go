@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// PROXY protocol https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+// Header is parsed in place in incomingBuffer, bytes after it stay there for the http parser.
+
+const proxyHeaderTimeout = 5 * time.Second
+const proxyV1MaxSize = 107
+const proxyV2HeaderSize = 16
+const proxyV2MaxAddressSize = proxyV2HeaderSize + 216 // Unix socket addresses, TLVs after addresses are skipped
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("Invalid PROXY protocol header")
+var errProxyHeaderTooBig = errors.New("PROXY protocol header too big") // Only v1, v2 length is 16 bits
+
+// prefixConn returns prefix bytes from Read before reading from Conn
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) != 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (s *Server) proxyProtocolTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range s.ProxyProtocolTrusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readMore appends at least one byte to incomingBuffer
+func (c *Client) readMore() error {
+	n, err := c.incomingReader.Read(c.incomingBuffer[c.incomingWritePos:])
+	c.incomingWritePos += n
+	if n == 0 && err == nil {
+		return errors.New("connection Read returned 0 bytes")
+	}
+	if n != 0 {
+		return nil
+	}
+	return err
+}
+
+// readProxyHeader returns real client address, or nil for LOCAL command and UNKNOWN protocol
+func (c *Client) readProxyHeader() (net.Addr, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+	for c.incomingWritePos < 1 {
+		if err := c.readMore(); err != nil {
+			return nil, err
+		}
+	}
+	var addr net.Addr
+	var err error
+	switch c.incomingBuffer[0] {
+	case 'P':
+		addr, err = c.readProxyHeaderV1()
+	case '\r':
+		addr, err = c.readProxyHeaderV2()
+	default:
+		return nil, errProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+func (c *Client) readProxyHeaderV1() (net.Addr, error) {
+	for {
+		ib := c.incomingBuffer[:c.incomingWritePos]
+		if end := bytes.IndexByte(ib, '\n'); end >= 0 {
+			if end == 0 || ib[end-1] != '\r' {
+				return nil, errProxyHeader
+			}
+			c.incomingReadPos = end + 1
+			return parseProxyHeaderV1(ib[:end-1])
+		}
+		if len(ib) >= proxyV1MaxSize {
+			return nil, errProxyHeaderTooBig
+		}
+		if err := c.readMore(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// "PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535" or "PROXY UNKNOWN ..."
+func parseProxyHeaderV1(ib []byte) (net.Addr, error) {
+	pos := 0
+	field := func() []byte {
+		start := pos
+		for pos < len(ib) && ib[pos] != ' ' {
+			pos++
+		}
+		f := ib[start:pos]
+		if pos < len(ib) {
+			pos++
+		}
+		return f
+	}
+	if string(field()) != "PROXY" {
+		return nil, errProxyHeader
+	}
+	proto := field()
+	if string(proto) == "UNKNOWN" {
+		return nil, nil // Rest of the line must be ignored
+	}
+	if string(proto) != "TCP4" && string(proto) != "TCP6" {
+		return nil, errProxyHeader
+	}
+	src, err := netip.ParseAddr(string(field()))
+	if err != nil || src.Is4() != (string(proto) == "TCP4") {
+		return nil, errProxyHeader
+	}
+	if _, err := netip.ParseAddr(string(field())); err != nil {
+		return nil, errProxyHeader
+	}
+	srcPort, err := strconv.ParseUint(string(field()), 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	if _, err := strconv.ParseUint(string(field()), 10, 16); err != nil || pos != len(ib) {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: src.AsSlice(), Port: int(srcPort)}, nil
+}
+
+func (c *Client) readProxyHeaderV2() (net.Addr, error) {
+	for c.incomingWritePos < proxyV2HeaderSize {
+		if err := c.readMore(); err != nil {
+			return nil, err
+		}
+	}
+	ib := c.incomingBuffer
+	if !bytes.Equal(ib[:12], proxyV2Signature) || ib[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	size := proxyV2HeaderSize + int(ib[14])<<8 + int(ib[15])
+	addressSize := min(size, proxyV2MaxAddressSize)
+	for c.incomingWritePos < addressSize {
+		if err := c.readMore(); err != nil {
+			return nil, err
+		}
+	}
+	addr, err := parseProxyHeaderV2(ib[:addressSize])
+	if err != nil {
+		return nil, err
+	}
+	// TLVs can be up to 64KB, larger than incomingBuffer, so they are read and dropped
+	for c.incomingWritePos < size {
+		size -= c.incomingWritePos
+		c.incomingWritePos = 0
+		if err := c.readMore(); err != nil {
+			return nil, err
+		}
+	}
+	c.incomingReadPos = size
+	return addr, nil
+}
+
+func parseProxyHeaderV2(ib []byte) (net.Addr, error) {
+	switch ib[12] & 0xF {
+	case 0: // LOCAL, health checks from the proxy itself
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	body := ib[proxyV2HeaderSize:]
+	switch ib[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]).To16(), Port: int(body[8])<<8 + int(body[9])}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		ip := make(net.IP, 16) // body is in incomingBuffer which will be overwritten by TLVs and requests
+		copy(ip, body[0:16])
+		return &net.TCPAddr{IP: ip, Port: int(body[32])<<8 + int(body[33])}, nil
+	}
+	return nil, nil // UNSPEC or unix sockets, must be accepted and ignored
+}
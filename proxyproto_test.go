@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func remoteAddrHandler(wr ResponseWriter, r *Request) {
+	addr := r.RemoteAddr.String()
+	wr.WriteContentLength(int64(len(addr)))
+	_, _ = wr.Write([]byte(addr))
+}
+
+func proxyServer(t *testing.T, trusted string) string {
+	s := &Server{handler: remoteAddrHandler, ProxyProtocol: true}
+	if trusted != "" {
+		_, n, err := net.ParseCIDR(trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ProxyProtocolTrusted = []*net.IPNet{n}
+	}
+	return startServer(t, s)
+}
+
+// proxyV2 builds binary header for TCP over IPv4 followed by tlvSize bytes of TLVs
+func proxyV2(src [4]byte, port uint16, tlvSize int) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x21, 0x11) // Version 2 PROXY, TCP over IPv4
+	b = binary.BigEndian.AppendUint16(b, uint16(12+tlvSize))
+	b = append(b, src[:]...)
+	b = append(b, 127, 0, 0, 1)
+	b = binary.BigEndian.AppendUint16(b, port)
+	b = binary.BigEndian.AppendUint16(b, 80)
+	for tlvSize > 0 {
+		size := min(tlvSize-3, 0xFFFF)
+		b = append(b, 0xEE) // Custom type, like AWS VPC endpoint ID
+		b = binary.BigEndian.AppendUint16(b, uint16(size))
+		b = append(b, bytes.Repeat([]byte{'t'}, size)...)
+		tlvSize -= 3 + size
+	}
+	return b
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	conn := dial(t, proxyServer(t, "127.0.0.0/8"))
+	_, got := roundTrip(t, conn, "PROXY TCP4 192.0.2.7 127.0.0.1 4711 80\r\nGET / HTTP/1.1\r\n\r\n")
+	if got != "192.0.2.7:4711" {
+		t.Fatal(got)
+	}
+}
+
+func TestProxyProtocolV2WithTLVs(t *testing.T) {
+	for _, tlvSize := range []int{0, 300, 3 * incomingBufferSize, 16 + 0xFFFF - 12 - 16} {
+		conn := dial(t, proxyServer(t, "127.0.0.0/8"))
+		header := proxyV2([4]byte{198, 51, 100, 9}, 5000, tlvSize)
+		_, got := roundTrip(t, conn, string(header)+"GET / HTTP/1.1\r\n\r\n")
+		if got != "198.51.100.9:5000" {
+			t.Fatalf("TLVs of %d bytes: %q", tlvSize, got)
+		}
+	}
+}
+
+func TestProxyProtocolUntrustedSource(t *testing.T) {
+	for _, trusted := range []string{"", "10.0.0.0/8"} {
+		conn := dial(t, proxyServer(t, trusted))
+		// Header is not expected from untrusted source, so it is an invalid request line
+		_, _ = conn.Write([]byte("PROXY TCP4 192.0.2.7 127.0.0.1 4711 80\r\nGET / HTTP/1.1\r\n\r\n"))
+		var b [64]byte
+		if n, _ := conn.Read(b[:]); bytes.Contains(b[:n], []byte("192.0.2.7")) {
+			t.Fatalf("trusted %q: %q", trusted, b[:n])
+		}
+	}
+}
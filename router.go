@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+)
+
+// RouteParam is a named path segment, Value points into request buffer and is valid only during handler call
+type RouteParam struct {
+	Key   string
+	Value []byte
+}
+
+// Router matches method and already decoded Request.Path with radix tree per method.
+// Patterns are like "/users/:id/files/*path", where :name matches single non-empty segment
+// and *name matches the rest of path (possibly empty) and must be last.
+// Static segments have priority over parameters, parameters over catch-all.
+// Matching does not allocate, Request.Params reuses its array between requests on the connection.
+type Router struct {
+	methods []routeMethod
+
+	NotFound         Handler // nil means plain 404
+	MethodNotAllowed Handler // nil means plain 405 with allow header
+}
+
+type routeMethod struct {
+	method string
+	root   *routeNode
+}
+
+type routeNode struct {
+	prefix   string
+	indices  []byte // First bytes of children prefixes
+	children []*routeNode
+	param    *routeNode
+	catchAll *routeNode
+
+	paramName string
+	handler   Handler
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle panics on invalid pattern or conflict with already registered routes
+func (rt *Router) Handle(method string, pattern string, handler Handler) {
+	if len(pattern) == 0 || pattern[0] != '/' {
+		panic("router: pattern must start with '/', got " + pattern)
+	}
+	root := rt.root(method)
+	if root == nil {
+		root = &routeNode{}
+		rt.methods = append(rt.methods, routeMethod{method: method, root: root})
+	}
+	root.insert(pattern, pattern, handler)
+}
+
+func (rt *Router) GET(pattern string, handler Handler)    { rt.Handle("GET", pattern, handler) }
+func (rt *Router) POST(pattern string, handler Handler)   { rt.Handle("POST", pattern, handler) }
+func (rt *Router) PUT(pattern string, handler Handler)    { rt.Handle("PUT", pattern, handler) }
+func (rt *Router) DELETE(pattern string, handler Handler) { rt.Handle("DELETE", pattern, handler) }
+
+func (rt *Router) root(method string) *routeNode {
+	for _, m := range rt.methods {
+		if m.method == method {
+			return m.root
+		}
+	}
+	return nil
+}
+
+// Serve is a Handler
+func (rt *Router) Serve(wr ResponseWriter, r *Request) {
+	for _, m := range rt.methods {
+		if m.method != string(r.Method) {
+			continue
+		}
+		if h := m.root.lookup(r.Path, r); h != nil {
+			h(wr, r)
+			return
+		}
+		break
+	}
+	allow := rt.allowed(r)
+	if allow == "" {
+		if rt.NotFound != nil {
+			rt.NotFound(wr, r)
+			return
+		}
+		writeSimpleResponse(wr, 404, "")
+		return
+	}
+	if rt.MethodNotAllowed != nil {
+		rt.MethodNotAllowed(wr, r)
+		return
+	}
+	writeSimpleResponse(wr, 405, allow)
+}
+
+// allowed returns comma-separated methods for which path matches, slow path so can allocate
+func (rt *Router) allowed(r *Request) string {
+	var sb strings.Builder
+	mark := len(r.Params)
+	for _, m := range rt.methods {
+		if m.method == string(r.Method) {
+			continue
+		}
+		h := m.root.lookup(r.Path, r)
+		r.Params = r.Params[:mark]
+		if h == nil {
+			continue
+		}
+		if sb.Len() != 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(m.method)
+	}
+	return sb.String()
+}
+
+func writeSimpleResponse(wr ResponseWriter, statusCode int, allow string) {
+	text := statusText(statusCode)
+	wr.WriteStatus(statusCode)
+	if allow != "" {
+		wr.WriteOtherHeader("allow", allow)
+	}
+	wr.WriteOtherHeader("content-type", "text/plain; charset=utf-8")
+	wr.WriteContentLength(int64(len(text)))
+	_, _ = wr.Write([]byte(text))
+}
+
+// Param returns value of route parameter, nil if not found
+func (r *Request) Param(name string) []byte {
+	for _, p := range r.Params {
+		if p.Key == name {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+func wildcardName(path string, pattern string) (string, string) {
+	end := strings.IndexByte(path, '/')
+	if end < 0 {
+		end = len(path)
+	}
+	name := path[1:end]
+	if len(name) == 0 || strings.ContainsAny(name, ":*") {
+		panic("router: invalid wildcard in pattern " + pattern)
+	}
+	return name, path[end:]
+}
+
+func (n *routeNode) staticChild(c byte) *routeNode {
+	for i, index := range n.indices {
+		if index == c {
+			return n.children[i]
+		}
+	}
+	return nil
+}
+
+func (n *routeNode) insert(path string, pattern string, handler Handler) {
+	for {
+		if len(path) == 0 {
+			if n.handler != nil {
+				panic("router: duplicate pattern " + pattern)
+			}
+			n.handler = handler
+			return
+		}
+		switch path[0] {
+		case ':':
+			name, rest := wildcardName(path, pattern)
+			if n.param == nil {
+				n.param = &routeNode{paramName: name}
+			} else if n.param.paramName != name {
+				panic("router: parameter :" + name + " conflicts with :" + n.param.paramName + " in pattern " + pattern)
+			}
+			n = n.param
+			path = rest
+			continue
+		case '*':
+			name, rest := wildcardName(path, pattern)
+			if rest != "" {
+				panic("router: catch-all must be the last in pattern " + pattern)
+			}
+			if n.catchAll != nil {
+				panic("router: duplicate catch-all in pattern " + pattern)
+			}
+			n.catchAll = &routeNode{paramName: name, handler: handler}
+			return
+		}
+		end := strings.IndexAny(path, ":*")
+		if end < 0 {
+			end = len(path)
+		}
+		chunk := path[:end]
+		child := n.staticChild(chunk[0])
+		if child == nil {
+			child = &routeNode{prefix: chunk}
+			n.indices = append(n.indices, chunk[0])
+			n.children = append(n.children, child)
+			n = child
+			path = path[end:]
+			continue
+		}
+		common := 0
+		for common < len(chunk) && common < len(child.prefix) && chunk[common] == child.prefix[common] {
+			common++
+		}
+		if common < len(child.prefix) { // Split child at common prefix
+			tail := *child
+			tail.prefix = child.prefix[common:]
+			*child = routeNode{
+				prefix:   child.prefix[:common],
+				indices:  []byte{tail.prefix[0]},
+				children: []*routeNode{&tail},
+			}
+		}
+		n = child
+		path = path[common:]
+	}
+}
+
+// lookup matches path after n.prefix, appending parameters to r.Params
+func (n *routeNode) lookup(path []byte, r *Request) Handler {
+	if len(path) == 0 && n.handler != nil {
+		return n.handler
+	}
+	if len(path) != 0 {
+		if child := n.staticChild(path[0]); child != nil && len(path) >= len(child.prefix) && string(path[:len(child.prefix)]) == child.prefix {
+			if h := child.lookup(path[len(child.prefix):], r); h != nil {
+				return h
+			}
+		}
+		if n.param != nil {
+			end := bytes.IndexByte(path, '/')
+			if end < 0 {
+				end = len(path)
+			}
+			if end != 0 {
+				mark := len(r.Params)
+				r.Params = append(r.Params, RouteParam{Key: n.param.paramName, Value: path[:end]})
+				if h := n.param.lookup(path[end:], r); h != nil {
+					return h
+				}
+				r.Params = r.Params[:mark]
+			}
+		}
+	}
+	if n.catchAll != nil {
+		r.Params = append(r.Params, RouteParam{Key: n.catchAll.paramName, Value: path})
+		return n.catchAll.handler
+	}
+	return nil
+}
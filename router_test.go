@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+// routeNameHandler answers with its name followed by route params
+func routeNameHandler(name string) Handler {
+	return func(wr ResponseWriter, r *Request) {
+		result := name
+		for _, p := range r.Params {
+			result += " " + p.Key + "=" + string(p.Value)
+		}
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}
+}
+
+func testRouter() *Router {
+	rt := NewRouter()
+	rt.GET("/", routeNameHandler("root"))
+	rt.GET("/users", routeNameHandler("users"))
+	rt.GET("/users/:id", routeNameHandler("user"))
+	rt.GET("/users/me", routeNameHandler("me"))
+	rt.GET("/users/:id/files/*path", routeNameHandler("files"))
+	rt.GET("/us", routeNameHandler("us"))
+	rt.POST("/users/:id", routeNameHandler("post user"))
+	rt.GET("/static/*rest", routeNameHandler("static"))
+	return rt
+}
+
+func TestRouterMatch(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: testRouter().Serve}))
+	for _, tc := range []struct{ method, path, want string }{
+		{"GET", "/", "root"},
+		{"GET", "/users", "users"},
+		{"GET", "/users/42", "user id=42"},
+		{"GET", "/users/me", "me"}, // Static before parameter
+		{"GET", "/users/7/files/a/b/c", "files id=7 path=a/b/c"},
+		{"GET", "/users/7/files/", "files id=7 path="},
+		{"GET", "/us", "us"},
+		{"GET", "/static/", "static rest="},
+		{"POST", "/users/5", "post user id=5"},
+	} {
+		resp, body := roundTrip(t, conn, tc.method+" "+tc.path+" HTTP/1.1\r\n\r\n")
+		if resp.StatusCode != 200 || body != tc.want {
+			t.Errorf("%s %s: %d %q, want %q", tc.method, tc.path, resp.StatusCode, body, tc.want)
+		}
+	}
+}
+
+func TestRouterNotFoundAndMethodNotAllowed(t *testing.T) {
+	rt := testRouter()
+	conn := dial(t, startServer(t, &Server{handler: rt.Serve}))
+	for _, path := range []string{"/nope", "/users/", "/users/7/files", "/use"} {
+		if resp, _ := roundTrip(t, conn, "GET "+path+" HTTP/1.1\r\n\r\n"); resp.StatusCode != 404 {
+			t.Errorf("%s: %d", path, resp.StatusCode)
+		}
+	}
+	resp, _ := roundTrip(t, conn, "DELETE /users/5 HTTP/1.1\r\n\r\n")
+	if resp.StatusCode != 405 || resp.Header.Get("Allow") != "GET, POST" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+	rt.NotFound = routeNameHandler("custom")
+	if _, body := roundTrip(t, conn, "GET /nope HTTP/1.1\r\n\r\n"); body != "custom" {
+		t.Fatal(body)
+	}
+}
+
+func TestRouterConflictPanics(t *testing.T) {
+	for _, pattern := range []string{"/users/:name", "/static/*other", "users", "/a/:", "/a/*x/b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", pattern)
+				}
+			}()
+			testRouter().GET(pattern, routeNameHandler("x"))
+		}()
+	}
+}
+
+func TestRouterLookupDoesNotAllocate(t *testing.T) {
+	rt := testRouter()
+	r := &Request{Path: []byte("/users/7/files/x"), Params: make([]RouteParam, 0, 4)}
+	root := rt.root("GET")
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Params = r.Params[:0]
+		if root.lookup(r.Path, r) == nil {
+			t.Fatal("not found")
+		}
+	})
+	if allocs != 0 {
+		t.Fatal(allocs)
+	}
+}
@@ -2,42 +2,99 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ResponseWriter without WriteContentLength before the first Write sends chunked body
 type ResponseWriter interface {
 	WriteStatus(statusCode int)
 	WriteDate(date string)
 	WriteServer(server string)
 	WriteContentLength(length int64)
 	WriteOtherHeader(key string, value string)
+	WriteSetCookie(cookie *Cookie) error // Validates cookie, error if invalid or headers already written
 	Write([]byte) (int, error)
-	// TODO UpgradeWebsocket
+	Flush() error
+	// Hijack takes over connection, for CONNECT tunnels, WebSockets and custom protocols.
+	// incoming are bytes already read beyond consumed part of request, outgoing is unflushed
+	// response data, which caller should send first. After Hijack, server never touches conn.
+	Hijack() (conn net.Conn, incoming []byte, outgoing []byte, err error)
 }
 
 type Handler func(wr ResponseWriter, request *Request)
 
 type Server struct {
-	listener net.Listener
-	handler  Handler
+	mu        sync.Mutex
+	listener  net.Listener
+	handler   Handler
+	done      chan struct{} // Closed by Close
+	date      atomic.Value  // Formatted date header, refreshed every second
+	clockOnce sync.Once
+	ctx       context.Context // Parent of request contexts, cancelled by Close
+	ctxCancel context.CancelFunc
+
+	headerTable *headerTable // Default one plus names from RegisterHeader, nil if none registered, fixed once serving
+
+	Clock Clock // Used for date header, nil means system clock
+
+	TLSConfig *tls.Config // Base config for ListerAndServerTLS, can be nil
+
+	ProxyProtocol        bool         // Expect PROXY protocol v1 or v2 header at connection start
+	ProxyProtocolTrusted []*net.IPNet // Expect header only from those sources, empty means from nobody, so it must be set
+
+	TrustedProxies []*net.IPNet // Forwarding headers from those sources are used by Request.ClientIP
+
+	RequestTimeout time.Duration // Deadline of Request.Context, 0 means no deadline
+
+	H2C bool // Serve HTTP/2 over cleartext, both by prior knowledge and by "Upgrade: h2c"
+
+	// Called when connection changes state, see ConnState
+	ConnState func(conn net.Conn, state ConnState)
+
+	// Called after handler panic is recovered and logged, for example to report to error tracker
+	PanicHandler func(request *Request, recovered interface{}, stack []byte)
 }
 
-var timeBuffer atomic.Value
+// ConnState is reported to Server.ConnState hook.
+// New -> (Active -> Idle)* -> (Hijacked | Closed)
+type ConnState int
 
-func init() {
-	timeBuffer.Store(appendTime(nil, time.Now()))
-	go func() {
-		time.Sleep(time.Millisecond * 500)
-		timeBuffer.Store(appendTime(nil, time.Now()))
-	}()
+const (
+	StateNew      ConnState = iota // Accepted, no complete request header yet
+	StateActive                    // Request header is read, handler is running
+	StateIdle                      // Response is sent, waiting for the next request
+	StateHijacked                  // Connection is taken over by handler, not reported as Closed
+	StateClosed
+)
+
+var connStateNames = [...]string{"new", "active", "idle", "hijacked", "closed"}
+
+func (state ConnState) String() string {
+	if state < 0 || int(state) >= len(connStateNames) {
+		return "unknown"
+	}
+	return connStateNames[state]
+}
+
+func (c *Client) setState(state ConnState) {
+	if c.server.ConnState != nil {
+		c.server.ConnState(c.rawConn, state)
+	}
 }
 
 type HeaderKV struct {
+	id    HeaderID
 	key   []byte
 	value []byte
 }
@@ -52,16 +109,22 @@ const (
 type Client struct {
 	server           *Server
 	conn             net.Conn
+	rawConn          net.Conn // As accepted, before TLS wrapping, reported to Server.ConnState
+	tlsConfig        *tls.Config
 	incomingBuffer   []byte
 	incomingReadPos  int
 	incomingWritePos int
+	bodyStart        int // End of current header, body reads never go below, so Request slices stay valid
+	headerLimit      int // 0 means maxHeaderSize
 
 	incomingReader   io.Reader
 	outgoingBuffer   []byte
 	outgoingWritePos int
 	//outgoingWriter *bufio.Writer
 
-	request Request
+	request    Request
+	requestNum int
+	startTime  time.Time
 
 	// Parser state
 	parseError          string
@@ -75,6 +138,7 @@ type Client struct {
 	headerValueStart    int
 	headerValueWritePos int // Due to continuations, we shift value bytes
 	headerCMSList       bool
+	rawTargetBuffer     []byte // Copy of escaped request-target, reused between requests
 
 	// Writer state
 	writerState                  int
@@ -82,6 +146,19 @@ type Client struct {
 	responseServerWritten        bool
 	responseContentLengthWritten int64
 	responseBytesWritten         int64
+	responseChunked              bool
+	responseStatus               int
+
+	body     bodyReader
+	hijacked bool
+
+	// Request context and background read, see Request.Context
+	requestStart         time.Time
+	cancel               context.CancelFunc
+	backgroundReadDone   chan struct{}
+	backgroundReadN      int
+	backgroundReadBuffer [64]byte // Enough to see that peer is still there
+	backgroundReadErr    error
 
 	// Debug
 	noncompleteCounter int
@@ -91,6 +168,7 @@ type Request struct {
 	Method             []byte
 	Path               []byte
 	QueryString        []byte
+	RawTarget          []byte // Path and query as received, before in-place decoding of Path and Args
 	VersionMinor       int
 	VersionMajor       int
 	KeepAlive          bool
@@ -104,16 +182,46 @@ type Request struct {
 	TransferEncodings       [][]byte
 	TransferEncodingChunked bool
 	Headers                 []HeaderKV
-
+	headerIndex             [maxHeaderIDs]uint8 // Position+1 in Headers by ID, see HeaderByID
+	headerIndexLen          int                 // len(Headers) when headerIndex was built, -1 if not built
+	headerTable             *headerTable        // Which assigned IDs of Headers, nil means defaultHeaderTable
+	Params                  []RouteParam        // Filled by Router
+	body                    io.Reader
+	decodedBody             io.Reader // Created by Body
+	rawBody                 io.Reader // Created by RawBody
+	args                    Args
+	argsParsed              bool
+	postArgs                Args
+	formParsed              bool
+	formErr                 error
+	formBuffer              []byte
+	cookies                 Args
+	cookiesParsed           bool
+	ctx                     context.Context
+
+	ConnectionTokens    [][]byte // All lowercase tokens of connection header
+	HopByHopHeaders     []HeaderKV
 	ConnectionUpgrade   bool
+	UpgradeProtocols    [][]byte // Lowercase, in order of client preference
 	UpgradeWebSocket    bool
 	SecWebsocketKey     []byte
 	SecWebsocketVersion []byte
+
+	// Client address, from PROXY protocol header if enabled, set for the lifetime of connection
+	RemoteAddr net.Addr
+
+	client     *Client // nil if request did not come from our connection
+	requestNum int     // Of connection, see ConnInfo
+
+	// Set for the lifetime of TLS connection, nil for plaintext
+	TLS              *tls.ConnectionState
+	PeerCertificates []*x509.Certificate
 }
 
 const incomingBufferSize = 4096
 const outgoingBufferSize = 4096
 const maxHeaderSize = 2048
+const minBodyBufferSize = maxChunkLineSize // Kept free after header for body reads
 const eofheaderGuardSize = 2
 
 var errOVerflow = errors.New("OVerflow")
@@ -162,6 +270,31 @@ func (c *Client) writeUint(value uint) error {
 	return nil
 }
 
+const maxChunkHeaderSize = 18
+const sendfileMinSize = 64 * 1024 // Smaller bodies are cheaper to copy through outgoingBuffer
+
+func (c *Client) ensureSpace(size int) error {
+	if c.outgoingWritePos+size > len(c.outgoingBuffer) {
+		return c.flush()
+	}
+	return nil
+}
+
+func (c *Client) writeHex(value uint) error {
+	const hexDigits = "0123456789abcdef"
+	var scratch [16]byte
+	p := len(scratch)
+	for {
+		p--
+		scratch[p] = hexDigits[value%16]
+		value /= 16
+		if value == 0 {
+			break
+		}
+	}
+	return c.write(scratch[p:])
+}
+
 func (c *Client) flush() error {
 	if c.outgoingWritePos != 0 {
 		_, err := c.conn.Write(c.outgoingBuffer[:c.outgoingWritePos])
@@ -194,10 +327,23 @@ func (c *Client) WriteStatus(statusCode int) {
 	c.writeByte(' ')
 	c.writeUint(uint(statusCode))
 	c.writeByte(' ')
-	c.writeString("OK\r\n") // TODO depending on status
+	c.writeString(statusText(statusCode))
+	c.writeString("\r\n")
+	c.responseStatus = statusCode
 	c.writerState = CONNECTION_EXPECT_HEADERS
 }
 
+func statusWithoutBody(statusCode int) bool {
+	return statusCode < 200 || statusCode == 204 || statusCode == 304
+}
+
+func statusText(statusCode int) string {
+	if text := http.StatusText(statusCode); text != "" {
+		return text
+	}
+	return "Unknown"
+}
+
 func (c *Client) WriteDate(date string) {
 	if c.writerState == CONNECTION_EXPECT_STATUS {
 		c.WriteStatus(200)
@@ -273,67 +419,214 @@ func appendTime(b []byte, t time.Time) []byte { // Copied from net.http
 		'G', 'M', 'T')
 }
 
+func (c *Client) writeHeadersEnd() {
+	if !c.responseServerWritten {
+		c.writeString("server: crab\r\n")
+		c.responseServerWritten = true
+	}
+	if !c.responseDateWritten {
+		c.writeString("date: ")
+		c.write(c.server.dateBuffer())
+		c.writeString("\r\n")
+		c.responseDateWritten = true
+	}
+	if c.responseContentLengthWritten < 0 && !statusWithoutBody(c.responseStatus) && string(c.request.Method) != "HEAD" {
+		if c.request.VersionMajor == 1 && c.request.VersionMinor >= 1 {
+			c.writeString("transfer-encoding: chunked\r\n")
+			c.responseChunked = true
+		} else { // HTTP/1.0 body is delimited by connection close
+			c.writeString("connection: close\r\n")
+			c.request.KeepAlive = false
+		}
+	}
+	c.writeString("\r\n")
+	c.writerState = CONNECTION_EXPECT_BODY
+}
+
 func (c *Client) Write(data []byte) (int, error) {
 	if c.writerState == CONNECTION_EXPECT_STATUS {
 		c.WriteStatus(200)
 	}
 	if c.writerState == CONNECTION_EXPECT_HEADERS {
-		if !c.responseServerWritten {
-			c.writeString("server: crab\r\n")
-			c.responseServerWritten = true
-		}
-		if !c.responseDateWritten {
-			// TODO cache in Server
-			//dateBuf := appendTime(nil, time.Now())
-			c.writeString("date: ")
-			dateBuf := timeBuffer.Load()
-			c.write(dateBuf.([]byte))
-			c.writeString("\r\n")
-			//c.writeString("date: Tue, 15 Nov 2020 12:45:26 GMT\r\n")
-			c.responseDateWritten = true
-		}
-		if c.responseContentLengthWritten < 0 { // TODO actually support chunked encoding
-			log.Fatalf("Chunked body not yet supported")
-			c.writeString("transfer-encoding: chunked\r\n")
-		}
-		c.writeString("\r\n")
-		c.writerState = CONNECTION_EXPECT_BODY
+		c.writeHeadersEnd()
 	}
 	if c.writerState != CONNECTION_EXPECT_BODY {
 		// TODO disconnect
 		return 0, errors.New("Unexpected body write")
 	}
-	origLen := len(data)
-	if c.responseContentLengthWritten >= 0 {
-		if c.responseBytesWritten+int64(len(data)) > c.responseContentLengthWritten {
-			return 0, errors.New("Body overflow")
+	if c.responseContentLengthWritten >= 0 && c.responseBytesWritten+int64(len(data)) > c.responseContentLengthWritten {
+		return 0, errors.New("Body overflow")
+	}
+	if len(data) == 0 {
+		return 0, nil // Empty chunk would terminate chunked body
+	}
+	if string(c.request.Method) == "HEAD" { // Handler can write body as for GET, it is counted but not sent
+		c.responseBytesWritten += int64(len(data))
+		return len(data), nil
+	}
+	if c.responseChunked {
+		if err := c.ensureSpace(maxChunkHeaderSize); err != nil {
+			return 0, err
+		}
+		c.writeHex(uint(len(data)))
+		c.writeString("\r\n")
+	}
+	if err := c.writeBody(data); err != nil {
+		// TODO disconnect
+		return 0, err
+	}
+	if c.responseChunked {
+		if err := c.ensureSpace(2); err != nil {
+			return 0, err
 		}
-		for {
-			if len(data) == 0 {
-				c.responseBytesWritten += int64(origLen)
-				return origLen, nil
+		c.writeString("\r\n")
+	}
+	c.responseBytesWritten += int64(len(data))
+	return len(data), nil
+}
+
+// writeBody copies data through outgoingBuffer, flushing it when full
+func (c *Client) writeBody(data []byte) error {
+	for len(data) != 0 {
+		copied := copy(c.outgoingBuffer[c.outgoingWritePos:], data)
+		c.outgoingWritePos += copied
+		data = data[copied:]
+		if c.outgoingWritePos == len(c.outgoingBuffer) {
+			if err := c.flush(); err != nil {
+				return err
 			}
-			copied := copy(c.outgoingBuffer[c.outgoingWritePos:], data)
-			c.outgoingWritePos += copied
-			data = data[copied:]
-			if c.outgoingWritePos == len(c.outgoingBuffer) {
-				_, err := c.conn.Write(c.outgoingBuffer)
-				if err != nil {
-					// TODO disconnect
-					return 0, err
-				}
-				c.outgoingWritePos = 0
+		}
+	}
+	return nil
+}
+
+// writerOnly hides ReadFrom, so io.Copy does not call it recursively
+type writerOnly struct {
+	io.Writer
+}
+
+// ReadFrom implements io.ReaderFrom, so io.Copy of a file uses sendfile on plain TCP connection
+// when content length is written and the rest of body is at least sendfileMinSize.
+// Otherwise src is read directly into outgoingBuffer.
+func (c *Client) ReadFrom(src io.Reader) (int64, error) {
+	if c.writerState == CONNECTION_EXPECT_STATUS || c.writerState == CONNECTION_EXPECT_HEADERS {
+		if _, err := c.Write(nil); err != nil {
+			return 0, err
+		}
+	}
+	if c.writerState != CONNECTION_EXPECT_BODY {
+		return 0, errors.New("Unexpected body write")
+	}
+	if c.responseChunked || c.responseContentLengthWritten < 0 || string(c.request.Method) == "HEAD" {
+		return io.Copy(writerOnly{c}, src)
+	}
+	remaining := c.responseContentLengthWritten - c.responseBytesWritten
+	limited, isLimited := src.(*io.LimitedReader)
+	if isLimited && limited.N < remaining { // Like io.CopyN
+		remaining = limited.N
+	}
+	if tcpConn, ok := c.conn.(*net.TCPConn); ok && remaining >= sendfileMinSize {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+		if isLimited { // sendfile looks only one LimitedReader deep for *os.File
+			src = limited.R
+		}
+		n, err := tcpConn.ReadFrom(io.LimitReader(src, remaining))
+		c.responseBytesWritten += n
+		if isLimited {
+			limited.N -= n
+		}
+		return n, err
+	}
+	var total int64
+	for remaining > 0 {
+		if c.outgoingWritePos == len(c.outgoingBuffer) {
+			if err := c.flush(); err != nil {
+				return total, err
 			}
 		}
+		buf := c.outgoingBuffer[c.outgoingWritePos:]
+		if int64(len(buf)) > remaining {
+			buf = buf[:remaining]
+		}
+		n, err := src.Read(buf)
+		c.outgoingWritePos += n
+		c.responseBytesWritten += int64(n)
+		remaining -= int64(n)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Flush sends status and headers if not yet, and everything written so far
+func (c *Client) Flush() error {
+	if c.writerState == CONNECTION_EXPECT_STATUS || c.writerState == CONNECTION_EXPECT_HEADERS {
+		if _, err := c.Write(nil); err != nil {
+			return err
+		}
+	}
+	return c.flush()
+}
+
+// finishResponse completes response after handler returns, returns false if connection must be closed
+func (c *Client) finishResponse() bool {
+	if c.writerState == CONNECTION_EXPECT_STATUS {
+		c.WriteStatus(200)
+	}
+	if c.writerState == CONNECTION_EXPECT_HEADERS {
+		if c.responseContentLengthWritten < 0 && !statusWithoutBody(c.responseStatus) {
+			c.WriteContentLength(0)
+		}
+		_, _ = c.Write(nil)
+	}
+	if c.responseChunked {
+		if c.ensureSpace(5) != nil {
+			return false
+		}
+		c.writeString("0\r\n\r\n")
+	}
+	if string(c.request.Method) == "HEAD" { // Content length of HEAD describes body which is not sent
+		return true
 	}
-	log.Fatalf("Chunked body not yet supported")
-	return 0, nil
+	// Client would wait for the rest of body forever
+	return c.responseContentLengthWritten < 0 || c.responseBytesWritten == c.responseContentLengthWritten
+}
+
+func (c *Client) Hijack() (net.Conn, []byte, []byte, error) {
+	if c.hijacked {
+		return nil, nil, nil, errors.New("Connection already hijacked")
+	}
+	c.hijacked = true
+	c.stopBackgroundRead()
+	incoming := append([]byte(nil), c.incomingBuffer[c.incomingReadPos:c.incomingWritePos]...)
+	outgoing := append([]byte(nil), c.outgoingBuffer[:c.outgoingWritePos]...)
+	c.incomingReadPos = 0
+	c.incomingWritePos = 0
+	c.outgoingWritePos = 0
+	c.writerState = CONNECTION_NO_WRITE
+	_ = c.conn.SetDeadline(time.Time{})
+	c.setState(StateHijacked)
+	return c.conn, incoming, outgoing, nil
+}
+
+func (c *Client) maxHeaderSize() int {
+	if c.headerLimit > 0 {
+		return c.headerLimit
+	}
+	return maxHeaderSize
 }
 
 func (c *Client) complete(rp int, wp int) bool {
 	ib := c.incomingBuffer
-	if wp > rp+maxHeaderSize {
-		wp = rp + maxHeaderSize // Do not look beyond maxHeaderSize
+	if limit := c.maxHeaderSize(); wp > rp+limit {
+		wp = rp + limit // Do not look beyond maxHeaderSize
 	}
 
 	for rp < wp {
@@ -358,7 +651,7 @@ func (c *Client) complete(rp int, wp int) bool {
 		}
 		if np+2 == wp {
 			// xxxxNx
-			if ib[wp+1] == '\n' {
+			if ib[np+1] == '\n' {
 				// xxxxNN
 				return true
 			}
@@ -397,6 +690,8 @@ func (c *Client) complete(rp int, wp int) bool {
 
 func (c *Client) readComplete() error {
 	incomingBuffer := c.incomingBuffer
+	maxHeaderSize := c.maxHeaderSize()
+	c.bodyStart = 0 // Previous message is finished
 	//incomingReadPos := c.incomingReadPos
 	//incomingWritePos := c.incomingWritePos
 	if c.incomingReadPos == c.incomingWritePos {
@@ -407,18 +702,17 @@ func (c *Client) readComplete() error {
 	} else {
 		//  xxx[xxxxxxxx]xxxxx
 		//     [     ] <- maxHeaderSize
+		if c.incomingReadPos+maxHeaderSize+minBodyBufferSize > len(incomingBuffer) {
+			// Inplace fragments cannot be circular, and body needs room after header, so defragment
+			c.incomingWritePos = copy(incomingBuffer, incomingBuffer[c.incomingReadPos:c.incomingWritePos])
+			c.incomingReadPos = 0
+		}
 		if c.complete(c.incomingReadPos, c.incomingWritePos) {
-			// do not care if it is at the end of buffer if it is complete
 			return nil
 		}
 		if c.incomingWritePos >= c.incomingReadPos+maxHeaderSize {
 			return errors.New("Incomplete header of max size")
 		}
-		if c.incomingReadPos+maxHeaderSize > len(incomingBuffer) {
-			// Inplace fragments cannot be circular, if in doubt, defragment
-			c.incomingWritePos = copy(incomingBuffer[c.incomingReadPos:c.incomingWritePos], incomingBuffer)
-			c.incomingReadPos = 0
-		}
 	}
 	// Here buffer is always checked for completeness, incomplete and less than maxHeaderSize
 	// xxx[ccccc]xxxxx  // c is checked for completeness
@@ -432,8 +726,8 @@ func (c *Client) readComplete() error {
 			log.Panicf("connection Read returned 0 bytes for slice of %d..%d bytes", c.incomingWritePos, len(c.incomingBuffer))
 		}
 		// xxx[cccccnnnnn]xxxxx  // c is checked for completeness, n is not
-		checkFrom := c.incomingWritePos
-		if checkFrom < c.incomingReadPos+3 {
+		checkFrom := c.incomingWritePos - 3 // NRN can be split between reads
+		if checkFrom < c.incomingReadPos {
 			checkFrom = c.incomingReadPos
 		}
 		c.incomingWritePos += n
@@ -464,8 +758,20 @@ func (c *Client) readRequest() error {
 	r.TransferEncodings = r.TransferEncodings[:0]
 	r.TransferEncodingChunked = false
 	r.Headers = r.Headers[:0]
-
+	r.headerIndexLen = -1
+	r.headerTable = nil
+	r.Params = r.Params[:0]
+	r.decodedBody = nil
+	r.rawBody = nil
+	r.argsParsed = false
+	r.formParsed = false
+	r.formErr = nil
+	r.cookiesParsed = false
+
+	r.ConnectionTokens = r.ConnectionTokens[:0]
+	r.HopByHopHeaders = r.HopByHopHeaders[:0]
 	r.ConnectionUpgrade = false
+	r.UpgradeProtocols = r.UpgradeProtocols[:0]
 	r.UpgradeWebSocket = false
 	r.SecWebsocketKey = nil
 	r.SecWebsocketVersion = nil
@@ -473,10 +779,19 @@ func (c *Client) readRequest() error {
 	if err := c.readComplete(); err != nil {
 		return err
 	}
+	if c.requestNum == 0 && c.server.H2C && bytes.HasPrefix(c.incomingBuffer[c.incomingReadPos:c.incomingWritePos], []byte(h2Preface[:18])) {
+		return errHTTP2Preface // "PRI * HTTP/2.0\r\n\r\n" looks like complete header to us
+	}
 	str := c.parse2()
 	if str != "" {
 		return errors.New(str)
 	}
+	if len(r.TransferEncodings) != 0 && !r.TransferEncodingChunked {
+		return errors.New("Transfer coding without chunked") // Body length is unknown, RFC 7230 section 3.3.3
+	}
+	r.stripHopByHopHeaders()
+	c.bodyStart = c.incomingReadPos
+	c.body.reset(r)
 	/*
 			state := METHOD_START
 			incomingReadPos := c.incomingReadPos
@@ -497,17 +812,71 @@ func (c *Client) readRequest() error {
 }
 
 func (c *Client) routine() {
+	c.request.RemoteAddr = c.conn.RemoteAddr()
+	if c.server.ProxyProtocol && c.server.proxyProtocolTrusted(c.conn.RemoteAddr()) {
+		addr, err := c.readProxyHeader()
+		if err != nil {
+			c.close()
+			return
+		}
+		if addr != nil {
+			c.request.RemoteAddr = addr
+		}
+	}
+	if c.tlsConfig != nil {
+		conn := c.conn
+		if c.incomingReadPos != c.incomingWritePos { // TLS bytes after PROXY header
+			prefix := append([]byte{}, c.incomingBuffer[c.incomingReadPos:c.incomingWritePos]...)
+			conn = &prefixConn{Conn: conn, prefix: prefix}
+		}
+		c.incomingReadPos = 0
+		c.incomingWritePos = 0
+		tlsConn := tls.Server(conn, c.tlsConfig)
+		c.conn = tlsConn
+		c.incomingReader = tlsConn
+		if err := c.handshakeTLS(tlsConn); err != nil {
+			c.close()
+			return
+		}
+	}
 	for {
 		err := c.readRequest()
+		if err == errHTTP2Preface {
+			c.serveHTTP2(nil, false)
+			return
+		}
 		if err != nil {
+			c.close()
 			return
 		}
+		if c.server.H2C {
+			if settings, ok := c.h2cUpgradeSettings(); ok {
+				c.serveHTTP2(settings, true)
+				return
+			}
+		}
 		c.writerState = CONNECTION_EXPECT_STATUS
 		c.responseDateWritten = false
 		c.responseServerWritten = false
 		c.responseBytesWritten = 0
 		c.responseContentLengthWritten = -1
-		c.server.handler(c, &c.request)
+		c.responseChunked = false
+		c.requestNum++
+		c.request.requestNum = c.requestNum
+		if c.server.RequestTimeout > 0 {
+			c.requestStart = time.Now()
+		}
+		c.setState(StateActive)
+		ok := c.callHandler()
+		if !c.finishContext() {
+			ok = false
+		}
+		if c.hijacked {
+			return
+		}
+		if ok {
+			ok = c.finishResponse()
+		}
 		// TODO - additional logic
 		//wr := c.outgoingWriter
 		//_, _ = wr.WriteString("HTTP/1.1 200 OK\r\n")
@@ -519,7 +888,54 @@ func (c *Client) routine() {
 		//_, _ = wr.WriteString("Hello, Crab!\r\n")
 
 		c.writerState = CONNECTION_NO_WRITE
-		_ = c.flush()
+		if err := c.flush(); err != nil || !ok || !c.request.KeepAlive || !c.body.discard() {
+			c.close()
+			return
+		}
+		c.setState(StateIdle)
+	}
+}
+
+func (c *Client) close() {
+	_ = c.conn.Close()
+	c.setState(StateClosed)
+}
+
+// callHandler returns false if connection must be closed after recovering from handler panic
+func (c *Client) callHandler() (ok bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			ok = false
+			c.handlePanic(recovered)
+		}
+	}()
+	c.server.handler(c, &c.request)
+	return true
+}
+
+func (c *Client) handlePanic(recovered interface{}) {
+	c.server.reportPanic(&c.request, recovered)
+	if c.hijacked {
+		return
+	}
+	if c.writerState != CONNECTION_EXPECT_STATUS {
+		c.outgoingWritePos = 0 // Partial response, client must see connection abort
+		return
+	}
+	c.WriteStatus(500)
+	c.WriteOtherHeader("connection", "close")
+	c.WriteContentLength(0)
+	_, _ = c.Write(nil)
+}
+
+// reportPanic logs recovered handler panic and calls PanicHandler, must be called from deferred function
+func (s *Server) reportPanic(request *Request, recovered interface{}) {
+	stack := debug.Stack()
+	if recovered != http.ErrAbortHandler { // Used by net/http handlers to abort silently
+		log.Printf("schwidko: panic serving %v: %v\n%s", request.RemoteAddr, recovered, stack)
+	}
+	if s.PanicHandler != nil {
+		s.PanicHandler(request, recovered, stack)
 	}
 }
 
@@ -528,19 +944,49 @@ func (s *Server) ListerAndServer(addr string) error {
 	if err != nil {
 		return err
 	}
+	return s.serve(l, nil)
+}
+
+// ListerAndServerTLS terminates TLS with certificates from store, selected by SNI
+func (s *Server) ListerAndServerTLS(addr string, certificates *CertificateStore) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.serve(l, certificates.Config(s.TLSConfig))
+}
+
+func (s *Server) serve(l net.Listener, tlsConfig *tls.Config) error {
+	s.mu.Lock()
 	s.listener = l
+	s.mu.Unlock()
+	if s.isClosed() {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	s.startClock()
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		client := &Client{
 			server:         s,
 			conn:           conn,
+			rawConn:        conn,
+			tlsConfig:      tlsConfig, // Handshake is in client goroutine, after PROXY header
 			incomingBuffer: make([]byte, incomingBufferSize),
 			incomingReader: conn,
 			outgoingBuffer: make([]byte, outgoingBufferSize),
+			startTime:      time.Now(),
 		}
+		client.request.client = client
+		client.request.body = &client.body
+		client.body.c = client
+		client.setState(StateNew)
 		go client.routine()
 	}
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// startServer serves s on a random local port until the test ends
+func startServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go s.serve(l, nil)
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// roundTrip writes raw request and reads one response with its body
+func roundTrip(t *testing.T, conn net.Conn, req string) (*http.Response, string) {
+	t.Helper()
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestHandlerPanicRecovered(t *testing.T) {
+	reported := make(chan interface{}, 2)
+	s := &Server{PanicHandler: func(r *Request, recovered interface{}, stack []byte) { reported <- recovered }, handler: func(wr ResponseWriter, r *Request) {
+		if string(r.Path) == "/late" {
+			wr.WriteContentLength(5)
+			_, _ = wr.Write([]byte("ab"))
+		}
+		panic(http.ErrAbortHandler) // Not logged, to keep test output clean
+	}}
+	addr := startServer(t, s)
+	resp, _ := roundTrip(t, dial(t, addr), "GET / HTTP/1.1\r\n\r\n")
+	if resp.Status != "500 Internal Server Error" || <-reported != http.ErrAbortHandler {
+		t.Fatal(resp.Status)
+	}
+	// Response is already started, so connection is closed instead of sending complete response
+	conn := dial(t, addr)
+	_, _ = io.WriteString(conn, "GET /late HTTP/1.1\r\n\r\n")
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+		if _, err = io.ReadAll(resp.Body); err != io.ErrUnexpectedEOF {
+			t.Fatal(resp.Status, err)
+		}
+	}
+	if <-reported != http.ErrAbortHandler {
+		t.Fatal("not reported")
+	}
+}
+
+// stateRecorder returns ConnState hook sending states to channel
+func stateRecorder() (func(net.Conn, ConnState), chan ConnState) {
+	states := make(chan ConnState, 16)
+	return func(conn net.Conn, state ConnState) { states <- state }, states
+}
+
+func okHandler(wr ResponseWriter, r *Request) {
+	wr.WriteContentLength(2)
+	_, _ = wr.Write([]byte("ok"))
+}
+
+func TestConnStateTransitions(t *testing.T) {
+	hook, states := stateRecorder()
+	conn := dial(t, startServer(t, &Server{ConnState: hook, handler: okHandler}))
+	roundTrip(t, conn, "GET / HTTP/1.1\r\n\r\n")
+	roundTrip(t, conn, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+	for _, want := range []ConnState{StateNew, StateActive, StateIdle, StateActive, StateClosed} {
+		if got := <-states; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestHTTP10ClosesWithoutKeepAlive(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: okHandler}))
+	_, _ = io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	all, err := io.ReadAll(conn) // Returns only after server closes
+	if err != nil || !bytes.HasSuffix(all, []byte("\r\n\r\nok")) {
+		t.Fatalf("%q %v", all, err)
+	}
+}
+
+func TestHijackAfterHeaders(t *testing.T) {
+	hook, states := stateRecorder()
+	s := &Server{ConnState: hook, handler: func(wr ResponseWriter, r *Request) {
+		wr.WriteContentLength(0)
+		_, _ = wr.Write(nil)
+		conn, incoming, outgoing, err := wr.Hijack()
+		if err != nil {
+			return
+		}
+		if _, _, _, err := wr.Hijack(); err == nil {
+			return
+		}
+		_, _ = conn.Write(outgoing)
+		_, _ = conn.Write([]byte("[" + string(incoming) + "]"))
+		_ = conn.Close()
+	}}
+	conn := dial(t, startServer(t, s))
+	_, _ = io.WriteString(conn, "CONNECT host:443 HTTP/1.1\r\n\r\nearly")
+	all, _ := io.ReadAll(conn)
+	if !bytes.HasPrefix(all, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.HasSuffix(all, []byte("\r\n\r\n[early]")) {
+		t.Fatalf("%q", all)
+	}
+	for _, want := range []ConnState{StateNew, StateActive, StateHijacked} {
+		if got := <-states; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
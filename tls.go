@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+const certificateCheckInterval = time.Second
+
+// CertificateStore keeps certificate/key pairs loaded from files, selects one by SNI
+// and reloads files after they change on disk, so certificates can be rotated without restart.
+// Files are checked not more often than once per certificateCheckInterval, from the handshake path.
+type CertificateStore struct {
+	mu    sync.RWMutex
+	pairs []*certificatePair
+
+	lastCheck int64 // unix nanoseconds
+}
+
+type certificatePair struct {
+	certFile string
+	keyFile  string
+	certMod  time.Time
+	keyMod   time.Time
+	cert     *tls.Certificate
+}
+
+var errNoCertificates = errors.New("No certificates in store")
+
+func NewCertificateStore() *CertificateStore {
+	return &CertificateStore{lastCheck: time.Now().UnixNano()}
+}
+
+// Add loads pair. The first pair added is used for clients without SNI or with unknown server name.
+func (s *CertificateStore) Add(certFile string, keyFile string) error {
+	p := &certificatePair{certFile: certFile, keyFile: keyFile}
+	if err := p.load(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.pairs = append(s.pairs, p)
+	s.mu.Unlock()
+	return nil
+}
+
+func fileModTime(name string) (time.Time, error) {
+	st, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return st.ModTime(), nil
+}
+
+func (p *certificatePair) load() error {
+	certMod, err := fileModTime(p.certFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := fileModTime(p.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil { // Needed for SupportsCertificate to be fast
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	p.certMod = certMod
+	p.keyMod = keyMod
+	p.cert = &cert
+	return nil
+}
+
+func (p *certificatePair) changed() bool {
+	certMod, err := fileModTime(p.certFile)
+	if err != nil {
+		return false
+	}
+	keyMod, err := fileModTime(p.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certMod.Equal(p.certMod) || !keyMod.Equal(p.keyMod)
+}
+
+// Reload checks all files and reloads changed pairs. If new files cannot be loaded
+// (for example, only one of the pair was replaced so far), old certificate is kept
+// and we will try again on the next check.
+func (s *CertificateStore) Reload() error {
+	s.mu.RLock()
+	var changed []*certificatePair
+	for _, p := range s.pairs {
+		if p.changed() {
+			changed = append(changed, p)
+		}
+	}
+	s.mu.RUnlock()
+	var firstErr error
+	for _, p := range changed {
+		fresh := &certificatePair{certFile: p.certFile, keyFile: p.keyFile}
+		if err := fresh.load(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		s.mu.Lock()
+		*p = *fresh
+		s.mu.Unlock()
+	}
+	return firstErr
+}
+
+func (s *CertificateStore) maybeReload() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.lastCheck)
+	if now-last < int64(certificateCheckInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&s.lastCheck, last, now) {
+		return // Other handshake is checking
+	}
+	_ = s.Reload()
+}
+
+// GetCertificate is suitable for tls.Config.GetCertificate
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.maybeReload()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.pairs) == 0 {
+		return nil, errNoCertificates
+	}
+	if hello.ServerName != "" {
+		for _, p := range s.pairs {
+			if hello.SupportsCertificate(p.cert) == nil {
+				return p.cert, nil
+			}
+		}
+	}
+	return s.pairs[0].cert, nil
+}
+
+// Config returns copy of base (can be nil) set up to take certificates from store
+func (s *CertificateStore) Config(base *tls.Config) *tls.Config {
+	var config *tls.Config
+	if base != nil {
+		config = base.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	config.GetCertificate = s.GetCertificate
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	return config
+}
+
+func (c *Client) handshakeTLS(tlsConn *tls.Conn) error {
+	if err := tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	c.request.TLS = &state
+	c.request.PeerCertificates = state.PeerCertificates
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes self-signed certificate for name and its key, with given mtime
+func writeCertificate(t *testing.T, certFile string, keyFile string, name string, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(mod.UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		name  string
+		block *pem.Block
+	}{{certFile, &pem.Block{Type: "CERTIFICATE", Bytes: der}}, {keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}}} {
+		if err := os.WriteFile(f.name, pem.EncodeToMemory(f.block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f.name, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func startTLSServer(t *testing.T, store *CertificateStore) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	s := &Server{handler: func(wr ResponseWriter, r *Request) {
+		result := "plain"
+		if r.TLS != nil {
+			result = r.TLS.ServerName
+		}
+		wr.WriteContentLength(int64(len(result)))
+		_, _ = wr.Write([]byte(result))
+	}}
+	go s.serve(l, store.Config(nil))
+	return l.Addr().String()
+}
+
+// served returns common name of certificate served for serverName, after checking request works
+func served(t *testing.T, addr string, serverName string) string {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: serverName, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Fatalf("ALPN %q", state.NegotiatedProtocol)
+	}
+	if _, body := roundTrip(t, conn, "GET / HTTP/1.1\r\n\r\n"); body != serverName {
+		t.Fatalf("handler saw %q, want %q", body, serverName)
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificateStoreSNI(t *testing.T) {
+	dir := t.TempDir()
+	store := NewCertificateStore()
+	for _, name := range []string{"a.test", "b.test"} {
+		certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+		writeCertificate(t, certFile, keyFile, name, time.Now())
+		if err := store.Add(certFile, keyFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := startTLSServer(t, store)
+	for serverName, want := range map[string]string{"a.test": "a.test", "b.test": "b.test", "c.test": "a.test", "": "a.test"} {
+		if got := served(t, addr, serverName); got != want {
+			t.Errorf("%q: got %q, want %q", serverName, got, want)
+		}
+	}
+}
+
+func TestCertificateStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "x.crt"), filepath.Join(dir, "x.key")
+	old := time.Now().Add(-time.Minute)
+	writeCertificate(t, certFile, keyFile, "old.test", old)
+	store := NewCertificateStore()
+	if err := store.Add(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	addr := startTLSServer(t, store)
+	if got := served(t, addr, "new.test"); got != "old.test" {
+		t.Fatal(got)
+	}
+	// Half-written rotation keeps old certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Fatal("no error for broken key")
+	}
+	if got := served(t, addr, "new.test"); got != "old.test" {
+		t.Fatal(got)
+	}
+	writeCertificate(t, certFile, keyFile, "new.test", time.Now())
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(t, addr, "new.test"); got != "new.test" {
+		t.Fatal(got)
+	}
+}
+
+func TestCertificateStoreEmpty(t *testing.T) {
+	if _, err := NewCertificateStore().GetCertificate(&tls.ClientHelloInfo{ServerName: "a.test"}); err != errNoCertificates {
+		t.Fatal(err)
+	}
+}
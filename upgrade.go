@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errUpgradeNotRequested = errors.New("Protocol upgrade not requested by client")
+
+// WantsUpgrade tells if client asked to switch to protocol (case-insensitive)
+func (r *Request) WantsUpgrade(protocol string) bool {
+	if !r.ConnectionUpgrade {
+		return false
+	}
+	for _, p := range r.UpgradeProtocols {
+		if len(p) != len(protocol) {
+			continue
+		}
+		i := 0
+		for i < len(p) && p[i] == toLower(protocol[i]) {
+			i++
+		}
+		if i == len(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Upgrade sends 101 Switching Protocols and hijacks connection for any protocol client asked for.
+// Protocol specific response headers (like sec-websocket-accept) can be written by handler
+// after WriteStatus(101) and before calling Upgrade. incoming are bytes client already sent
+// in the new protocol.
+func Upgrade(wr ResponseWriter, r *Request, protocol string) (net.Conn, []byte, error) {
+	if !r.WantsUpgrade(protocol) {
+		return nil, nil, errUpgradeNotRequested
+	}
+	wr.WriteStatus(101)
+	wr.WriteOtherHeader("connection", "upgrade")
+	wr.WriteOtherHeader("upgrade", protocol)
+	if err := wr.Flush(); err != nil {
+		return nil, nil, err
+	}
+	conn, incoming, outgoing, err := wr.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(outgoing) != 0 {
+		if _, err := conn.Write(outgoing); err != nil {
+			_ = conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, incoming, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// upgradeHandler answers with connection tokens, end-to-end and hop-by-hop header names,
+// or switches to protocol "foo" which echoes bytes after prefix
+func upgradeHandler(wr ResponseWriter, r *Request) {
+	if r.WantsUpgrade("foo") {
+		wr.WriteStatus(101)
+		wr.WriteOtherHeader("x-extra", "1")
+		conn, incoming, err := Upgrade(wr, r, "foo")
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("FOO:" + string(incoming)))
+		_ = conn.Close()
+		return
+	}
+	var names []string
+	for _, list := range [][]HeaderKV{r.Headers, r.HopByHopHeaders} {
+		for _, kv := range list {
+			names = append(names, string(kv.key))
+		}
+		names = append(names, "|")
+	}
+	for _, token := range r.ConnectionTokens {
+		names = append(names, string(token))
+	}
+	result := strings.Join(names, " ")
+	wr.WriteContentLength(int64(len(result)))
+	_, _ = wr.Write([]byte(result))
+}
+
+func TestConnectionTokensAndHopByHopHeaders(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: upgradeHandler}))
+	_, got := roundTrip(t, conn, "GET / HTTP/1.1\r\nConnection: keep-alive, TE\r\nTE: trailers\r\nX-A: 1\r\nUpgrade: bar\r\n\r\n")
+	if got != "x-a | te | keep-alive te" {
+		t.Fatal(got)
+	}
+}
+
+func TestUpgradeToRequestedProtocol(t *testing.T) {
+	conn := dial(t, startServer(t, &Server{handler: upgradeHandler}))
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c, Foo/1, FOO\r\nHTTP2-Settings: AAA\r\n\r\nhello")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Upgrade") != "foo" || resp.Header.Get("Connection") != "upgrade" || resp.Header.Get("X-Extra") != "1" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+	if rest, _ := io.ReadAll(br); string(rest) != "FOO:hello" {
+		t.Fatalf("%q", rest)
+	}
+}
+
+func TestUpgradeNotRequested(t *testing.T) {
+	var upgradeErr error
+	done := make(chan struct{})
+	conn := dial(t, startServer(t, &Server{handler: func(wr ResponseWriter, r *Request) {
+		defer close(done)
+		_, _, upgradeErr = Upgrade(wr, r, "foo")
+		okHandler(wr, r)
+	}}))
+	roundTrip(t, conn, "GET / HTTP/1.1\r\nUpgrade: foo\r\n\r\n") // Without Connection: upgrade
+	<-done
+	if upgradeErr == nil {
+		t.Fatal("upgraded")
+	}
+}